@@ -0,0 +1,249 @@
+package main
+
+/*
+	Audit trail: with -audit every StockHistory field a step changes on an existing record is logged
+	in StockHistoryChanges with the old value, the new value, the run id and the step.
+	1. before a write the current values of the $set fields are read for the records in the batch
+	2. after the write succeeded the fields whose value differs are inserted as FieldChange documents
+	New records (upserts that insert) and the bookkeeping fields (schemaversion, algoversions) are not logged.
+*/
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mylib2"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CHANGELOGCOLLECTION = "StockHistoryChanges"
+
+// AuditLog is set by -audit. nil means changes are not logged
+var Audit *AuditLog
+
+type AuditLog struct {
+	RunID string
+}
+
+// FieldChange is one changed field of one StockHistory record
+type FieldChange struct {
+	RunID      string      `bson:"runid"`
+	Step       string      `bson:"step"`
+	Underlying string      `bson:"underlying"`
+	Datadate   time.Time   `bson:"datadate"`
+	Field      string      `bson:"field"`
+	Old        interface{} `bson:"old"`
+	New        interface{} `bson:"new"`
+	Changed    time.Time   `bson:"changed"`
+}
+
+// auditedUpdate is a queued update in the shape the audit needs
+type auditedUpdate struct {
+	filter bson.D
+	update bson.D
+}
+
+func isBookkeepingField(key string) bool {
+	return key == "schemaversion" || strings.HasPrefix(key, "algoversions.")
+}
+
+// recordKey pulls underlying and datadate out of a filter. ok is false for any other kind of filter
+func recordKey(filter bson.D) (underlying string, datadate time.Time, ok bool) {
+	var hasU, hasD bool
+	for _, e := range filter {
+		switch e.Key {
+		case "underlying":
+			underlying, hasU = e.Value.(string)
+		case "datadate":
+			datadate, hasD = e.Value.(time.Time)
+		}
+	}
+	return underlying, datadate, hasU && hasD
+}
+
+func keyString(underlying string, datadate time.Time) string {
+	return underlying + "|" + datadate.UTC().Format(time.RFC3339Nano)
+}
+
+// setFields returns the audited fields of an update's $set
+func setFields(update bson.D) bson.D {
+	var res bson.D
+	for _, op := range update {
+		if op.Key != "$set" {
+			continue
+		}
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		for _, f := range fields {
+			if !isBookkeepingField(f.Key) {
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+// ReadOldValues reads the current documents of the records the updates touch, keyed by underlying and date
+func (a *AuditLog) ReadOldValues(ctx context.Context, updates []auditedUpdate) (map[string]bson.Raw, error) {
+	res := make(map[string]bson.Raw)
+	var or bson.A
+	projection := bson.D{{Key: "underlying", Value: 1}, {Key: "datadate", Value: 1}}
+	projected := make(map[string]bool)
+	for _, u := range updates {
+		underlying, datadate, ok := recordKey(u.filter)
+		if !ok {
+			continue
+		}
+		or = append(or, bson.D{{Key: "underlying", Value: underlying}, {Key: "datadate", Value: datadate}})
+		for _, f := range setFields(u.update) {
+			top := strings.Split(f.Key, ".")[0]
+			if !projected[top] {
+				projected[top] = true
+				projection = append(projection, bson.E{Key: top, Value: 1})
+			}
+		}
+	}
+	if len(or) == 0 {
+		return res, nil
+	}
+	coll := mylib2.GetCollection("StockHistory")
+	err := WithRetry(ctx, "audit read", func() error {
+		cursor, err := coll.Find(ctx, bson.D{{Key: "$or", Value: or}}, options.Find().SetProjection(projection))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var key struct {
+				Underlying string    `bson:"underlying"`
+				Datadate   time.Time `bson:"datadate"`
+			}
+			if err := cursor.Decode(&key); err != nil {
+				return err
+			}
+			res[keyString(key.Underlying, key.Datadate)] = append(bson.Raw(nil), cursor.Current...)
+		}
+		return cursor.Err()
+	})
+	return res, err
+}
+
+// LogChanges compares the new values with old and stores the fields that changed
+func (a *AuditLog) LogChanges(ctx context.Context, step string, updates []auditedUpdate, old map[string]bson.Raw) error {
+	var changes []interface{}
+
+	now := time.Now()
+	for _, u := range updates {
+		underlying, datadate, ok := recordKey(u.filter)
+		if !ok {
+			continue
+		}
+		doc, ok := old[keyString(underlying, datadate)]
+		if !ok {
+			continue
+		}
+		for _, f := range setFields(u.update) {
+			t, data, err := bson.MarshalValue(f.Value)
+			if err != nil {
+				return err
+			}
+			var oldValue interface{}
+			prev, err := doc.LookupErr(strings.Split(f.Key, ".")...)
+			if err == nil {
+				if prev.Type == t && bytes.Equal(prev.Value, data) || sameNumber(prev, bson.RawValue{Type: t, Value: data}) {
+					continue
+				}
+				oldValue = prev
+			}
+			changes = append(changes, FieldChange{RunID: a.RunID, Step: step, Underlying: underlying, Datadate: datadate,
+				Field: f.Key, Old: oldValue, New: f.Value, Changed: now})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	coll := mylib2.GetCollection(CHANGELOGCOLLECTION)
+	return WithRetry(ctx, "audit write", func() error {
+		_, err := coll.InsertMany(ctx, changes, options.InsertMany().SetOrdered(false))
+		return err
+	})
+}
+
+// sameNumber treats numbers stored with a different bson type (e.g. int32 and int64) as equal
+func sameNumber(a bson.RawValue, b bson.RawValue) bool {
+	x, ok := numberValue(a)
+	if !ok {
+		return false
+	}
+	y, ok := numberValue(b)
+	return ok && x == y
+}
+
+func numberValue(v bson.RawValue) (float64, bool) {
+	if f, ok := v.DoubleOK(); ok {
+		return f, true
+	}
+	if i, ok := v.Int32OK(); ok {
+		return float64(i), true
+	}
+	if i, ok := v.Int64OK(); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// UpdateStockHistoryOne updates one StockHistory record, retrying transient errors, with the audit trail when it's on
+func UpdateStockHistoryOne(ctx context.Context, step string, filter bson.D, update bson.D) (int64, int64, error) {
+	var res *mongo.UpdateResult
+
+	coll := mylib2.GetCollection("StockHistory")
+	write := func() error {
+		return WithRetry(ctx, step+" update", func() (err error) {
+			res, err = coll.UpdateOne(ctx, filter, update)
+			return err
+		})
+	}
+	if Audit == nil {
+		if err := write(); err != nil {
+			return 0, 0, err
+		}
+		return res.MatchedCount, res.ModifiedCount, nil
+	}
+	updates := []auditedUpdate{{filter: filter, update: update}}
+	old, err := Audit.ReadOldValues(ctx, updates)
+	if err != nil {
+		fmt.Printf("Can't read values for the audit trail: %v\n", err)
+	}
+	if err := write(); err != nil {
+		return 0, 0, err
+	}
+	if err == nil && res.ModifiedCount > 0 {
+		if err := Audit.LogChanges(ctx, step, updates, old); err != nil {
+			fmt.Printf("Can't write the audit trail: %v\n", err)
+		}
+	}
+	return res.MatchedCount, res.ModifiedCount, nil
+}
+
+// FieldHistory returns the logged changes of a symbol and date, oldest first. An empty field means all fields
+func FieldHistory(ctx context.Context, symbol string, date time.Time, field string) ([]FieldChange, error) {
+	var res []FieldChange
+
+	filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "datadate", Value: date}}
+	if field != "" {
+		filter = append(filter, bson.E{Key: "field", Value: field})
+	}
+	coll := mylib2.GetCollection(CHANGELOGCOLLECTION)
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "changed", Value: 1}, {Key: "field", Value: 1}}))
+	if err != nil {
+		return res, err
+	}
+	err = cursor.All(ctx, &res)
+	return res, err
+}
@@ -0,0 +1,435 @@
+package main
+
+/*
+	Maintenance commands. Run as: xhist2 <command> [flags]
+	Without a command xhist2 does the regular stock history run.
+*/
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mylib2"
+	"strings"
+	"time"
+)
+
+// RunCommand runs a maintenance command and returns the process exit code
+func RunCommand(name string, args []string) int {
+	switch name {
+	case "rename":
+		return renameCommand(args)
+	case "delist":
+		return delistCommand(args)
+	case "universe":
+		return universeCommand(args)
+	case "watchlist":
+		return watchlistCommand(args)
+	case "steps":
+		return stepsCommand()
+	case "locks":
+		return locksCommand(args)
+	case "queue":
+		return queueCommand(args)
+	case "init-db":
+		return initDBCommand(args)
+	case "migrate":
+		return migrateCommand(args)
+	case "recompute":
+		return recomputeCommand(args)
+	case "changes":
+		return changesCommand(args)
+	default:
+		fmt.Printf("unknown command %v. commands are: rename, delist, universe, watchlist, steps, locks, queue, init-db, migrate, recompute, changes\n", name)
+		return 2
+	}
+}
+
+func renameCommand(args []string) int {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	fromFlag := fs.String("from", "", "old ticker")
+	toFlag := fs.String("to", "", "new ticker")
+	dateFlag := fs.String("date", "", "first trading day under the new ticker, YYYY-MM-DD")
+	fs.Parse(args)
+
+	date, err := time.Parse("2006-01-02", *dateFlag)
+	if err != nil || *fromFlag == "" || *toFlag == "" {
+		fmt.Println("rename needs -from, -to and -date=YYYY-MM-DD")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	if err := RecordRename(*fromFlag, *toFlag, date); err != nil {
+		fmt.Printf("can't record rename: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%v renamed to %v on %v\n", *fromFlag, *toFlag, *dateFlag)
+	return 0
+}
+
+func delistCommand(args []string) int {
+	fs := flag.NewFlagSet("delist", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	symbolFlag := fs.String("symbol", "", "delisted ticker")
+	dateFlag := fs.String("date", "", "delisting date, YYYY-MM-DD")
+	fs.Parse(args)
+
+	date, err := time.Parse("2006-01-02", *dateFlag)
+	if err != nil || *symbolFlag == "" {
+		fmt.Println("delist needs -symbol and -date=YYYY-MM-DD")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	if err := RecordDelisting(*symbolFlag, date); err != nil {
+		fmt.Printf("can't record delisting: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%v marked inactive as of %v\n", *symbolFlag, *dateFlag)
+	return 0
+}
+
+func universeCommand(args []string) int {
+	fs := flag.NewFlagSet("universe", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	dateFlag := fs.String("date", "", "membership date, YYYY-MM-DD")
+	fs.Parse(args)
+
+	date, err := time.Parse("2006-01-02", *dateFlag)
+	if err != nil {
+		fmt.Println("universe needs -date=YYYY-MM-DD")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	snap, err := UniverseOn(WEEKLYUNIVERSE, date)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("%v universe on %v (snapshot %v): %v symbols\n", snap.Universe, *dateFlag,
+		snap.Date.Format("2006-01-02"), len(snap.Symbols))
+	for _, s := range snap.Symbols {
+		fmt.Println(s)
+	}
+	return 0
+}
+
+func watchlistCommand(args []string) int {
+	fs := flag.NewFlagSet("watchlist", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	nameFlag := fs.String("name", "", "watchlist name, e.g. semis")
+	setFlag := fs.String("set", "", "replace the watchlist with these symbols, same format as -symbol")
+	fs.Parse(args)
+
+	if *nameFlag == "" {
+		fmt.Println("watchlist needs -name")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	if *setFlag != "" {
+		weekly, err := mylib2.GetWeeklyStocks()
+		if err != nil {
+			fmt.Printf("can't get weekly stocks: %v\n", err)
+		}
+		symbols, _, err := SelectSymbols(*setFlag, "", weekly)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if err := SaveWatchlist(Watchlist{Name: *nameFlag, Symbols: symbols}); err != nil {
+			fmt.Printf("can't save watchlist: %v\n", err)
+			return 1
+		}
+	}
+	wl, err := GetWatchlist(*nameFlag)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("%v: %v symbols\n%v\n", wl.Name, len(wl.Symbols), strings.Join(wl.Symbols, ","))
+	return 0
+}
+
+func stepsCommand() int {
+	for _, step := range StepRegistry {
+		line := fmt.Sprintf("%v v%v", step.Name, step.Version)
+		if len(step.DependsOn) > 0 {
+			line += " (after " + strings.Join(step.DependsOn, ",") + ")"
+		}
+		if step.Enricher != nil {
+			line += ": " + DescribeEnricher(step.Enricher)
+		}
+		fmt.Println(line)
+	}
+	return 0
+}
+
+func locksCommand(args []string) int {
+	fs := flag.NewFlagSet("locks", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	breakFlag := fs.String("break", "", "remove this lock, e.g. PROD or PROD/AAPL. only when its run is known to be dead")
+	fs.Parse(args)
+
+	mylib2.InitDB(*envFlag)
+	if *breakFlag != "" {
+		removed, err := BreakLock(*breakFlag)
+		if err != nil {
+			fmt.Printf("can't break lock: %v\n", err)
+			return 1
+		}
+		if !removed {
+			fmt.Printf("no lock %v\n", *breakFlag)
+			return 1
+		}
+		fmt.Printf("lock %v removed\n", *breakFlag)
+		return 0
+	}
+	locks, err := ListLocks()
+	if err != nil {
+		fmt.Printf("can't read locks: %v\n", err)
+		return 1
+	}
+	now := time.Now()
+	for _, l := range locks {
+		state := "held"
+		if l.Expires.Before(now) {
+			state = "expired"
+		}
+		fmt.Printf("%-20v %-8v run %v on %v (pid %v) since %v, expires %v\n", l.Name, state, l.RunID, l.Host, l.Pid,
+			l.Acquired.Format(time.DateTime), l.Expires.Format(time.DateTime))
+	}
+	return 0
+}
+
+func queueCommand(args []string) int {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	nameFlag := fs.String("name", "", "queue name")
+	purgeFlag := fs.Bool("purge", false, "remove all jobs of the queue")
+	fs.Parse(args)
+
+	if *nameFlag == "" {
+		fmt.Println("queue needs -name")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	queue := NewQueue(mylib2.GetCollection(QUEUECOLLECTION), *nameFlag, QUEUEVISIBILITY)
+	if *purgeFlag {
+		removed, err := queue.Purge(context.TODO())
+		if err != nil {
+			fmt.Printf("can't purge queue: %v\n", err)
+			return 1
+		}
+		fmt.Printf("removed %v jobs from %v\n", removed, *nameFlag)
+		return 0
+	}
+	counts, err := queue.Counts(context.TODO())
+	if err != nil {
+		fmt.Printf("can't read queue: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%v: %v pending, %v claimed, %v done, %v failed\n", *nameFlag, counts[JOBPENDING], counts[JOBCLAIMED],
+		counts[JOBDONE], counts[JOBFAILED])
+	return 0
+}
+
+// initDBCommand creates the missing indexes and sets the validator. With -check it only reports
+// and exits 1 when the database drifted from the expected definition
+func initDBCommand(args []string) int {
+	fs := flag.NewFlagSet("init-db", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	checkFlag := fs.Bool("check", false, "only report drift, change nothing")
+	validatorFlag := fs.String("validator", VALIDATOROFF, "StockHistory $jsonSchema validator: off, warn or error. off leaves the current one alone")
+	fs.Parse(args)
+
+	if *validatorFlag != VALIDATOROFF && *validatorFlag != VALIDATORWARN && *validatorFlag != VALIDATORERROR {
+		fmt.Printf("INVALID validator mode %v. use off, warn or error\n", *validatorFlag)
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	ctx := context.TODO()
+	drift, err := CheckIndexes(ctx, !*checkFlag)
+	if err != nil {
+		fmt.Printf("can't check indexes: %v\n", err)
+		return 1
+	}
+	if *validatorFlag != VALIDATOROFF {
+		vdrift, err := CheckValidator(ctx, *validatorFlag, !*checkFlag)
+		if err != nil {
+			fmt.Printf("can't check validator: %v\n", err)
+			return 1
+		}
+		drift = append(drift, vdrift...)
+	}
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	if len(drift) > 0 && *checkFlag {
+		return 1
+	}
+	fmt.Printf("%v: %v differences\n", *envFlag, len(drift))
+	return 0
+}
+
+// migrateCommand brings StockHistory to the current schema version. It's safe to stop and run again
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	batchFlag := fs.Int("batch", MIGRATIONBATCHSIZE, "documents per batch")
+	dryFlag := fs.Bool("dry", false, "only count the documents per version")
+	fs.Parse(args)
+
+	if *batchFlag < 1 {
+		fmt.Printf("INVALID batch size %v\n", *batchFlag)
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	ctx := context.TODO()
+	counts, err := CountSchemaVersions(ctx)
+	if err != nil {
+		fmt.Printf("can't count schema versions: %v\n", err)
+		return 1
+	}
+	for _, m := range Migrations {
+		fmt.Printf("version %v: %v documents. %v to %v: %v\n", m.From, counts[m.From], m.From, m.From+1, m.Description)
+	}
+	if *dryFlag {
+		return 0
+	}
+	for _, m := range Migrations {
+		n, err := RunMigration(ctx, m, *batchFlag)
+		if err != nil {
+			fmt.Printf("migration stopped after %v documents: %v\n", n, err)
+			return 1
+		}
+	}
+	fmt.Printf("StockHistory is at schema version %v\n", STOCKHISTORYSCHEMAVERSION)
+	return 0
+}
+
+// recomputeCommand refreshes the records written by an older version of a step
+func recomputeCommand(args []string) int {
+	fs := flag.NewFlagSet("recompute", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	symbolFlag := fs.String("symbol", "0", "symbols to check, same syntax as the run. 0 is every symbol in StockHistory")
+	stepsFlag := fs.String("steps", "all", "comma separated steps to check: "+strings.Join(StepNames(), ","))
+	fundamentalsFlag := fs.String("fundamentals", "", "fundamentals source for the fundamentals step: mongo or a json file")
+	dividendsFlag := fs.String("dividends", "", "dividend calendar source for the dividends step: mongo or a json file")
+	corpActionsFlag := fs.String("corpactions", "", "splits and spin-offs source: mongo or a json file")
+	dryFlag := fs.Bool("dry", false, "only list what would be recomputed")
+	auditFlag := fs.Bool("audit", false, "log every changed StockHistory field with its old value in "+CHANGELOGCOLLECTION)
+	fs.Parse(args)
+
+	mylib2.InitDB(*envFlag)
+	ctx := context.TODO()
+	steps, err := ResolveSteps(*stepsFlag)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	var symbols []string
+	if !IsFullUniverseSpec(*symbolFlag) {
+		symbols, _, err = SelectSymbols(*symbolFlag, "", nil)
+		if err != nil {
+			fmt.Printf("can't select symbols: %v\n", err)
+			return 2
+		}
+	}
+	opts := RunOptions{Force: true, OnError: ONERRORSKIP, Env: *envFlag}
+	if opts.Fundamentals, err = NewFundamentalsSource(*fundamentalsFlag); err != nil {
+		fmt.Printf("can't open fundamentals source: %v\n", err)
+		return 1
+	}
+	if opts.Dividends, err = NewDividendSource(*dividendsFlag); err != nil {
+		fmt.Printf("can't open dividends source: %v\n", err)
+		return 1
+	}
+	if opts.CorporateActions, err = NewCorporateActionSource(*corpActionsFlag); err != nil {
+		fmt.Printf("can't open corporate actions source: %v\n", err)
+		return 1
+	}
+	// a step without its source can't recompute anything, leave its records behind
+	var withSource []Step
+	for _, s := range steps {
+		if s.Enricher != nil && !s.Enricher.HasSource(opts) {
+			fmt.Printf("not recomputing %v: no source configured\n", s.Name)
+			continue
+		}
+		withSource = append(withSource, s)
+	}
+	plans, err := PlanRecompute(ctx, withSource, symbols)
+	if err != nil {
+		fmt.Printf("can't find records to recompute: %v\n", err)
+		return 1
+	}
+	for _, p := range plans {
+		fmt.Printf("%v: %v from %v to %v, %v records\n", p.Symbol, StepListString(p.Steps), p.Range.From.Format("2006-01-02"),
+			p.Range.To.Format("2006-01-02"), p.Records)
+	}
+	if *dryFlag || len(plans) == 0 {
+		fmt.Printf("%v symbols to recompute\n", len(plans))
+		return 0
+	}
+
+	var planned []string
+	for _, p := range plans {
+		planned = append(planned, p.Symbol)
+	}
+	run := NewRunRecord(*envFlag, RUNRECOMPUTE, planned)
+	if err := SaveRunRecord(run); err != nil {
+		fmt.Printf("Can't record run: %v\n", err)
+	}
+	opts.RunID = run.RunID
+	if *auditFlag {
+		Audit = &AuditLog{RunID: run.RunID}
+	}
+
+	var results []SymbolResult
+	for _, p := range plans {
+		symOpts := opts
+		symOpts.Steps = p.Steps
+		symOpts.Range = p.Range
+		results = append(results, processWithLock(ctx, p.Symbol, symOpts))
+	}
+	report := NewRunReport(run, results)
+	report.PrintSummary()
+	status := RUNCOMPLETE
+	if report.Failed > 0 {
+		status = RUNINCOMPLETE
+	}
+	if err := FinishRun(run.RunID, status); err != nil {
+		fmt.Printf("Can't update run: %v\n", err)
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// changesCommand prints the audit trail of a symbol and date
+func changesCommand(args []string) int {
+	fs := flag.NewFlagSet("changes", flag.ExitOnError)
+	envFlag := fs.String("env", "DEV", "Environment: dev or prod")
+	symbolFlag := fs.String("symbol", "", "ticker")
+	dateFlag := fs.String("date", "", "record date, YYYY-MM-DD")
+	fieldFlag := fs.String("field", "", "only this field, e.g. ivpercentile30. default is all fields")
+	fs.Parse(args)
+
+	date, err := time.Parse("2006-01-02", *dateFlag)
+	if err != nil || *symbolFlag == "" {
+		fmt.Println("changes needs -symbol and -date=YYYY-MM-DD")
+		return 2
+	}
+	mylib2.InitDB(*envFlag)
+	changes, err := FieldHistory(context.TODO(), *symbolFlag, date, *fieldFlag)
+	if err != nil {
+		fmt.Printf("can't read changes: %v\n", err)
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Printf("no changes logged for %v %v\n", *symbolFlag, *dateFlag)
+		return 0
+	}
+	for _, c := range changes {
+		fmt.Printf("%v %-28v %v -> %v (run %v, step %v)\n", c.Changed.Format(time.DateTime), c.Field, c.Old, c.New, c.RunID, c.Step)
+	}
+	return 0
+}
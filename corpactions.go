@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// corporate action types
+const (
+	ACTIONSPLIT        = "split"
+	ACTIONREVERSESPLIT = "reversesplit"
+	ACTIONSPINOFF      = "spinoff"
+)
+
+// CorporateAction is a price changing event effective at the open of Date.
+// Ratio is new shares per old share for splits (4 for a 4:1, 0.1 for a 1:10 reverse split).
+// Factor is the part of the parent's value left after a spin-off (0.85 if the spun off unit was 15%)
+type CorporateAction struct {
+	Symbol string    `bson:"symbol"`
+	Date   time.Time `bson:"date"`
+	Type   string    `bson:"type"`
+	Ratio  float64   `bson:"ratio"`
+	Factor float64   `bson:"factor"`
+}
+
+// PriceFactor is what prices before the action are multiplied by to line up with prices after it. 1 if unknown
+func (a CorporateAction) PriceFactor() float64 {
+	switch a.Type {
+	case ACTIONSPLIT, ACTIONREVERSESPLIT:
+		if a.Ratio > 0 {
+			return 1 / a.Ratio
+		}
+	case ACTIONSPINOFF:
+		if a.Factor > 0 && a.Factor < 1 {
+			return a.Factor
+		}
+	}
+	return 1
+}
+
+// CorporateActionSource provides the splits, reverse splits and spin-offs of a symbol, in any order
+type CorporateActionSource interface {
+	GetCorporateActions(symbol string) ([]CorporateAction, error)
+}
+
+// NewCorporateActionSource picks the source for the -corpactions flag: "mongo" or a path to a json file
+func NewCorporateActionSource(spec string) (CorporateActionSource, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "mongo":
+		return MongoCorporateActionSource{Collection: "CorporateActions"}, nil
+	default:
+		return NewFileCorporateActionSource(spec)
+	}
+}
+
+// MongoCorporateActionSource reads corporate actions loaded by the data feeds
+type MongoCorporateActionSource struct {
+	Collection string
+}
+
+func (s MongoCorporateActionSource) GetCorporateActions(symbol string) ([]CorporateAction, error) {
+	return FindSymbolSorted[CorporateAction](context.TODO(), s.Collection, symbol, "date")
+}
+
+// FileCorporateActionSource serves corporate actions from a json file. The file is an array of
+// {"symbol": "NVDA", "date": "2024-06-10", "type": "split", "ratio": 10}
+type FileCorporateActionSource struct {
+	Path string
+	recs map[string][]CorporateAction
+}
+
+type fileCorporateAction struct {
+	Symbol string  `json:"symbol"`
+	Date   string  `json:"date"`
+	Type   string  `json:"type"`
+	Ratio  float64 `json:"ratio"`
+	Factor float64 `json:"factor"`
+}
+
+func (r fileCorporateAction) symbolDate() (string, string) { return r.Symbol, r.Date }
+
+func NewFileCorporateActionSource(path string) (*FileCorporateActionSource, error) {
+	recs, err := ReadDatedFile(path, func(r fileCorporateAction, d time.Time) CorporateAction {
+		return CorporateAction{Symbol: r.Symbol, Date: d, Type: r.Type, Ratio: r.Ratio, Factor: r.Factor}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FileCorporateActionSource{Path: path, recs: recs}, nil
+}
+
+func (s *FileCorporateActionSource) GetCorporateActions(symbol string) ([]CorporateAction, error) {
+	return s.recs[symbol], nil
+}
+
+// SplitAdjustFactors returns the multiplier that puts each price on the same share basis as the latest one.
+// hist must be sorted oldest first
+func SplitAdjustFactors(hist []mylib2.StockHistory, actions []CorporateAction) []float64 {
+	factors := make([]float64, len(hist))
+	for i := range factors {
+		factors[i] = 1
+	}
+	for _, a := range actions {
+		f := a.PriceFactor()
+		if f == 1 {
+			continue
+		}
+		idx := sort.Search(len(hist), func(i int) bool {
+			return !hist[i].Datadate.Before(a.Date)
+		})
+		// an announced action after the last record doesn't change the latest basis yet
+		if idx == len(hist) {
+			continue
+		}
+		for j := 0; j < idx; j++ {
+			factors[j] *= f
+		}
+	}
+	return factors
+}
+
+// SplitAdjustedHistory returns a copy of hist, sorted oldest first, with UnderlyingPrice split adjusted.
+// The raw prices in the collection are never changed. Price derived metrics should run on this copy.
+// A nil source means raw prices, a source that can't be read is an error
+func SplitAdjustedHistory(symbol string, hist []mylib2.StockHistory, source CorporateActionSource) ([]mylib2.StockHistory, []float64, error) {
+	adjusted := make([]mylib2.StockHistory, len(hist))
+	copy(adjusted, hist)
+	sort.Slice(adjusted, func(i, j int) bool {
+		return adjusted[i].Datadate.Before(adjusted[j].Datadate)
+	})
+	if source == nil {
+		return adjusted, SplitAdjustFactors(adjusted, nil), nil
+	}
+	actions, err := source.GetCorporateActions(symbol)
+	if err != nil {
+		return adjusted, nil, fmt.Errorf("can't get corporate actions for %v: %w", symbol, err)
+	}
+	factors := SplitAdjustFactors(adjusted, actions)
+	for i, f := range factors {
+		adjusted[i].UnderlyingPrice = adjusted[i].UnderlyingPrice * f
+	}
+	return adjusted, factors, nil
+}
+
+// SplitAdjustEnricher stores the split adjusted price and its factor on every record
+type SplitAdjustEnricher struct{}
+
+func (SplitAdjustEnricher) Name() string { return "splitadj" }
+
+func (SplitAdjustEnricher) Version() int { return 1 }
+
+func (SplitAdjustEnricher) HasSource(opts RunOptions) bool { return opts.CorporateActions != nil }
+
+func (SplitAdjustEnricher) Inputs() []string { return []string{"datadate", "underlyingprice"} }
+
+func (SplitAdjustEnricher) Outputs() []string { return []string{"splitadjprice", "splitadjfactor"} }
+
+func (SplitAdjustEnricher) Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error) {
+	var res []EnrichedRec
+
+	if opts.CorporateActions == nil {
+		return res, nil
+	}
+	adjusted, factors, err := SplitAdjustedHistory(symbol, hist, opts.CorporateActions)
+	if err != nil {
+		return res, err
+	}
+	for i, day := range adjusted {
+		res = append(res, EnrichedRec{Datadate: day.Datadate, Fields: bson.D{{Key: "splitadjprice", Value: day.UnderlyingPrice},
+			{Key: "splitadjfactor", Value: factors[i]}}})
+	}
+	return res, nil
+}
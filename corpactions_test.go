@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"mylib2"
+	"testing"
+	"time"
+)
+
+// testHistory builds consecutive daily records from 2024-03-01 with the given prices
+func testHistory(prices ...float64) []mylib2.StockHistory {
+	var res []mylib2.StockHistory
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, p := range prices {
+		res = append(res, mylib2.StockHistory{Underlying: "TEST", Datadate: start.AddDate(0, 0, i), UnderlyingPrice: p})
+	}
+	return res
+}
+
+func testDay(d int) time.Time {
+	return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC)
+}
+
+func sameFactors(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitAdjustFactors(t *testing.T) {
+	hist := testHistory(400, 410, 41, 42)
+	tests := []struct {
+		name    string
+		actions []CorporateAction
+		want    []float64
+	}{
+		{"none", nil, []float64{1, 1, 1, 1}},
+		{"split", []CorporateAction{{Date: testDay(3), Type: ACTIONSPLIT, Ratio: 10}}, []float64{0.1, 0.1, 1, 1}},
+		{"reverse split", []CorporateAction{{Date: testDay(2), Type: ACTIONREVERSESPLIT, Ratio: 0.5}}, []float64{2, 1, 1, 1}},
+		{"spin-off", []CorporateAction{{Date: testDay(4), Type: ACTIONSPINOFF, Factor: 0.8}}, []float64{0.8, 0.8, 0.8, 1}},
+		{"two splits", []CorporateAction{{Date: testDay(4), Type: ACTIONSPLIT, Ratio: 2}, {Date: testDay(2), Type: ACTIONSPLIT, Ratio: 2}},
+			[]float64{0.25, 0.5, 0.5, 1}},
+		{"on the first record", []CorporateAction{{Date: testDay(1), Type: ACTIONSPLIT, Ratio: 10}}, []float64{1, 1, 1, 1}},
+		{"before the first record", []CorporateAction{{Date: testDay(1).AddDate(0, 0, -5), Type: ACTIONSPLIT, Ratio: 10}}, []float64{1, 1, 1, 1}},
+		{"after the last record", []CorporateAction{{Date: testDay(10), Type: ACTIONSPLIT, Ratio: 10}}, []float64{1, 1, 1, 1}},
+		{"no ratio", []CorporateAction{{Date: testDay(3), Type: ACTIONSPLIT}}, []float64{1, 1, 1, 1}},
+		{"spin-off factor out of range", []CorporateAction{{Date: testDay(3), Type: ACTIONSPINOFF, Factor: 1.2}}, []float64{1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		if got := SplitAdjustFactors(hist, tt.actions); !sameFactors(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
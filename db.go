@@ -0,0 +1,221 @@
+package main
+
+/*
+	Mongo helpers for the operations mylib2 does not wrap (bulk writes, upserts, and reads and writes
+	that need retries and errors).
+	Collections come from mylib2 so we share its connection and the -env selection.
+*/
+import (
+	"context"
+	"fmt"
+	"mylib2"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const BULKBATCHSIZE int = 1000
+const STOCKHISTORYKEYINDEX = "underlying_1_datadate_1_unique"
+
+// BulkUpdater collects UpdateOne models and writes them with unordered BulkWrite calls
+type BulkUpdater struct {
+	Collection string
+	Matched    int64
+	Modified   int64
+	Upserted   int64
+	// Upsert inserts the document when the filter matches nothing
+	Upsert bool
+	// Step names the writer in the audit trail
+	Step    string
+	models  []mongo.WriteModel
+	updates []auditedUpdate
+}
+
+func NewBulkUpdater(collection string) *BulkUpdater {
+	return &BulkUpdater{Collection: collection}
+}
+
+// Add queues an update and flushes once a batch is full
+func (b *BulkUpdater) Add(ctx context.Context, filter bson.D, update bson.D) error {
+	b.models = append(b.models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(b.Upsert))
+	b.updates = append(b.updates, auditedUpdate{filter: filter, update: update})
+	if len(b.models) >= BULKBATCHSIZE {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes whatever is queued
+func (b *BulkUpdater) Flush(ctx context.Context) error {
+	if len(b.models) == 0 {
+		return nil
+	}
+	var old map[string]bson.Raw
+	audit := Audit != nil && b.Collection == "StockHistory"
+	if audit {
+		var err error
+		if old, err = Audit.ReadOldValues(ctx, b.updates); err != nil {
+			fmt.Printf("Can't read values for the audit trail: %v\n", err)
+			audit = false
+		}
+	}
+	coll := mylib2.GetCollection(b.Collection)
+	opts := options.BulkWrite().SetOrdered(false)
+	// the batch only holds updates, so writing it again after a transient error is safe
+	var res *mongo.BulkWriteResult
+	err := WithRetry(ctx, "bulk write to "+b.Collection, func() (err error) {
+		res, err = coll.BulkWrite(ctx, b.models, opts)
+		return err
+	})
+	if res != nil {
+		b.Matched += res.MatchedCount
+		b.Modified += res.ModifiedCount
+		b.Upserted += res.UpsertedCount
+	}
+	if audit && err == nil {
+		if err := Audit.LogChanges(ctx, b.Step, b.updates, old); err != nil {
+			fmt.Printf("Can't write the audit trail: %v\n", err)
+		}
+	}
+	b.models = b.models[:0]
+	b.updates = b.updates[:0]
+	return err
+}
+
+// fields VolTrend computes. everything else on a record belongs to a later step and
+// rewriting a base record must not blank it
+var baseFields = map[string]bool{"underlying": true, "datadate": true, "weekday": true, "underlyingprice": true,
+	"lastearningsdate": true, "nextearningsdate": true, "lastearningssurprise": true, "isearnings": true}
+
+// isBaseField tells if VolTrend writes key: the fields above and the day<N> option fields, but not
+// the day<N>voiv volatility of IV that ivpct adds
+func isBaseField(key string) bool {
+	if baseFields[key] {
+		return true
+	}
+	return strings.HasPrefix(key, "day") && !strings.HasSuffix(key, "voiv")
+}
+
+// BaseRecordFields returns the fields VolTrend computes for rec, ready for a $set
+func BaseRecordFields(rec mylib2.StockHistory) (bson.D, error) {
+	var doc bson.D
+	var res bson.D
+
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return res, err
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return res, err
+	}
+	for _, e := range doc {
+		if !isBaseField(e.Key) {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// EnsureStockHistoryIndex creates the unique (underlying, datadate) index the upserts rely on.
+// It's a no-op when such an index exists (under any name) and fails when the collection already holds duplicates
+func EnsureStockHistoryIndex(ctx context.Context) error {
+	def := stockHistoryKeyIndex
+	coll := mylib2.GetCollection(def.Collection)
+	existing, err := ListIndexes(ctx, coll)
+	if err != nil {
+		return err
+	}
+	for _, idx := range existing {
+		if idx.Unique && SameIndexKeys(idx.Key, def.Keys) {
+			return nil
+		}
+	}
+	model := mongo.IndexModel{Keys: def.Keys, Options: options.Index().SetUnique(true).SetName(def.Name)}
+	return WithRetry(ctx, "StockHistory index", func() error {
+		_, err := coll.Indexes().CreateOne(ctx, model)
+		return err
+	})
+}
+
+// IndexSpec is the part of an index definition we compare
+type IndexSpec struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+func ListIndexes(ctx context.Context, coll *mongo.Collection) ([]IndexSpec, error) {
+	var res []IndexSpec
+
+	err := WithRetry(ctx, "list indexes of "+coll.Name(), func() error {
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &res)
+	})
+	return res, err
+}
+
+// SameIndexKeys compares key patterns field by field, in order. 1 and int32(1) are the same
+func SameIndexKeys(a bson.D, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpsertStockHistoryRecs writes base records keyed on underlying and datadate. Existing records
+// get their base fields replaced and keep everything the enrichment steps added
+func UpsertStockHistoryRecs(ctx context.Context, hist []mylib2.StockHistory) (*BulkUpdater, error) {
+	bulk := NewBulkUpdater("StockHistory")
+	bulk.Upsert = true
+	bulk.Step = "base"
+	for _, rec := range hist {
+		fields, err := BaseRecordFields(rec)
+		if err != nil {
+			return bulk, err
+		}
+		filter := bson.D{{Key: "underlying", Value: rec.Underlying}, {Key: "datadate", Value: rec.Datadate}}
+		fields = append(fields, AlgoVersion("base", BASEVERSION))
+		// only new records are at the current schema version, existing ones are the migrator's job
+		update := bson.D{{Key: "$set", Value: fields},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "schemaversion", Value: STOCKHISTORYSCHEMAVERSION}}}}
+		if err := bulk.Add(ctx, filter, update); err != nil {
+			return bulk, err
+		}
+	}
+	err := bulk.Flush(ctx)
+	if err == nil {
+		fmt.Printf("Upserted %v, updated %v stock history records\n", bulk.Upserted, bulk.Modified)
+	}
+	return bulk, err
+}
+
+// FindStockHistory reads the StockHistory records matching filter, oldest first
+func FindStockHistory(ctx context.Context, filter bson.D) ([]mylib2.StockHistory, error) {
+	var res []mylib2.StockHistory
+
+	coll := mylib2.GetCollection("StockHistory")
+	opts := options.Find().SetSort(bson.D{{Key: "datadate", Value: 1}})
+	err := WithRetry(ctx, "read stock history", func() error {
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		res = nil
+		return cursor.All(ctx, &res)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoHistory, err)
+	}
+	return res, nil
+}
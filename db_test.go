@@ -0,0 +1,29 @@
+package main
+
+import (
+	"mylib2"
+	"testing"
+	"time"
+)
+
+func TestBaseRecordFields(t *testing.T) {
+	rec := mylib2.StockHistory{Underlying: "TEST", Datadate: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Day30: 0.25}
+	fields, err := BaseRecordFields(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, f := range fields {
+		got[f.Key] = true
+	}
+	for _, key := range []string{"underlying", "datadate", "underlyingprice", "day30", "day30expiration", "lastearningsdate"} {
+		if !got[key] {
+			t.Errorf("%v missing from the base fields", key)
+		}
+	}
+	for _, key := range []string{"ratings", "expectedmove", "ivpercentile30", "day30voiv", "histvol", "upricechange1", "dcf"} {
+		if got[key] {
+			t.Errorf("%v is written by another step but is in the base fields", key)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DividendRec is one cash dividend keyed by its ex-dividend date
+type DividendRec struct {
+	Symbol string    `bson:"symbol"`
+	ExDate time.Time `bson:"exdate"`
+	Amount float64   `bson:"amount"`
+}
+
+// DividendSource provides the dividend calendar of a symbol, past and announced, in any order
+type DividendSource interface {
+	GetDividends(symbol string) ([]DividendRec, error)
+}
+
+// NewDividendSource picks the source for the -dividends flag: "mongo" or a path to a json file
+func NewDividendSource(spec string) (DividendSource, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "mongo":
+		return MongoDividendSource{Collection: "Dividends"}, nil
+	default:
+		return NewFileDividendSource(spec)
+	}
+}
+
+// MongoDividendSource reads the dividend calendar loaded by the data feeds
+type MongoDividendSource struct {
+	Collection string
+}
+
+func (s MongoDividendSource) GetDividends(symbol string) ([]DividendRec, error) {
+	return FindSymbolSorted[DividendRec](context.TODO(), s.Collection, symbol, "exdate")
+}
+
+// FileDividendSource serves dividends from a json file. The file is an array of
+// {"symbol": "KO", "exdate": "2024-03-14", "amount": 0.485}
+type FileDividendSource struct {
+	Path string
+	recs map[string][]DividendRec
+}
+
+type fileDividendRec struct {
+	Symbol string  `json:"symbol"`
+	ExDate string  `json:"exdate"`
+	Amount float64 `json:"amount"`
+}
+
+func (r fileDividendRec) symbolDate() (string, string) { return r.Symbol, r.ExDate }
+
+func NewFileDividendSource(path string) (*FileDividendSource, error) {
+	recs, err := ReadDatedFile(path, func(r fileDividendRec, d time.Time) DividendRec {
+		return DividendRec{Symbol: r.Symbol, ExDate: d, Amount: r.Amount}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FileDividendSource{Path: path, recs: recs}, nil
+}
+
+func (s *FileDividendSource) GetDividends(symbol string) ([]DividendRec, error) {
+	return s.recs[symbol], nil
+}
+
+/*
+	Dividend logic:
+	1. every day gets the next ex-dividend date on or after it, its amount and the trading days until it
+	   (put only ATM IV is distorted around ex-dates so rules need to see them coming)
+	2. total return prices: every price before an ex-date is scaled by (1 - amount / close before the ex-date).
+	   The scaling is done on top of the split adjusted prices
+	3. upricechange and histvol are recomputed on the adjusted prices with the same 252 day window
+	   as AddIVpercentiles and stored next to the raw ones with a "tr" suffix
+*/
+
+// DividendEnricher stores the dividend calendar fields and the total return price changes
+type DividendEnricher struct{}
+
+func (DividendEnricher) Name() string { return "dividends" }
+
+func (DividendEnricher) Version() int { return 1 }
+
+func (DividendEnricher) HasSource(opts RunOptions) bool { return opts.Dividends != nil }
+
+func (DividendEnricher) Inputs() []string { return []string{"datadate", "underlyingprice"} }
+
+func (DividendEnricher) Outputs() []string {
+	return []string{"nextexdividenddate", "dividendamount", "tradingdaystoexdividend",
+		"upricechange1tr", "upricechange5tr", "upricechange10tr", "upricechange30tr", "upricechange90tr",
+		"upricechange365tr", "histvoltr", "maxuptr", "maxdowntr"}
+}
+
+func (DividendEnricher) Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error) {
+	var res []EnrichedRec
+
+	if opts.Dividends == nil {
+		return res, nil
+	}
+	divs, err := opts.Dividends.GetDividends(symbol)
+	if err != nil {
+		return res, err
+	}
+	if len(divs) == 0 {
+		// the total return fields are still written, they equal the split adjusted ones
+		fmt.Printf("no dividends for %v\n", symbol)
+	}
+	sort.Slice(divs, func(i, j int) bool {
+		return divs[i].ExDate.Before(divs[j].ExDate)
+	})
+	histDates := make([]time.Time, 0, len(hist))
+	for _, day := range hist {
+		histDates = append(histDates, day.Datadate)
+	}
+
+	// amounts are per share at the time, so the ratio is taken on raw prices
+	adjusted, _, err := SplitAdjustedHistory(symbol, hist, opts.CorporateActions)
+	if err != nil {
+		return res, err
+	}
+	for i, f := range TotalReturnFactors(hist, divs) {
+		adjusted[i].UnderlyingPrice = adjusted[i].UnderlyingPrice * f
+	}
+
+	d := 0
+	for i, day := range hist {
+		var fields bson.D
+
+		for d < len(divs) && divs[d].ExDate.Before(day.Datadate) {
+			d++
+		}
+		if d < len(divs) {
+			fields = append(fields, bson.E{Key: "nextexdividenddate", Value: divs[d].ExDate},
+				bson.E{Key: "dividendamount", Value: divs[d].Amount},
+				bson.E{Key: "tradingdaystoexdividend", Value: TradingDaysBetween(histDates, day.Datadate, divs[d].ExDate)})
+		}
+		if i >= TDAYSANNUALY {
+			slice := adjusted[i-TDAYSANNUALY : i+1]
+			last := len(slice) - 1
+			hvol, maxUp, maxDown := CalcHistVolForPeriod(slice, TDAYSANNUALY)
+			fields = append(fields, bson.E{Key: "upricechange1tr", Value: CalcUpriceChange2(slice, last, -1)},
+				bson.E{Key: "upricechange5tr", Value: CalcUpriceChange2(slice, last, -5)},
+				bson.E{Key: "upricechange10tr", Value: CalcUpriceChange2(slice, last, -10)},
+				bson.E{Key: "upricechange30tr", Value: CalcUpriceChange2(slice, last, -TDAYSMONTHLY)},
+				bson.E{Key: "upricechange90tr", Value: CalcUpriceChange2(slice, last, -TDAYSQUARTERLY)},
+				bson.E{Key: "upricechange365tr", Value: CalcUpriceChange2(slice, last, -TDAYSANNUALY)},
+				bson.E{Key: "histvoltr", Value: hvol},
+				bson.E{Key: "maxuptr", Value: maxUp},
+				bson.E{Key: "maxdowntr", Value: maxDown})
+		}
+		res = append(res, EnrichedRec{Datadate: day.Datadate, Fields: fields})
+	}
+	return res, nil
+}
+
+// TotalReturnFactors returns the multiplier that turns each raw price into a total return price.
+// hist and divs must be sorted oldest first
+func TotalReturnFactors(hist []mylib2.StockHistory, divs []DividendRec) []float64 {
+	factors := make([]float64, len(hist))
+	for i := range factors {
+		factors[i] = 1
+	}
+	for _, div := range divs {
+		idx := sort.Search(len(hist), func(i int) bool {
+			return !hist[i].Datadate.Before(div.ExDate)
+		})
+		if idx == 0 || idx == len(hist) {
+			continue
+		}
+		prev := hist[idx-1].UnderlyingPrice
+		if prev <= 0 || div.Amount <= 0 || div.Amount >= prev {
+			continue
+		}
+		f := 1 - div.Amount/prev
+		for j := 0; j < idx; j++ {
+			factors[j] *= f
+		}
+	}
+	return factors
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTotalReturnFactors(t *testing.T) {
+	hist := testHistory(100, 100, 98, 99)
+	tests := []struct {
+		name string
+		divs []DividendRec
+		want []float64
+	}{
+		{"none", nil, []float64{1, 1, 1, 1}},
+		{"one", []DividendRec{{ExDate: testDay(3), Amount: 2}}, []float64{0.98, 0.98, 1, 1}},
+		{"two", []DividendRec{{ExDate: testDay(2), Amount: 1}, {ExDate: testDay(4), Amount: 0.98}},
+			[]float64{0.99 * 0.99, 0.99, 0.99, 1}},
+		// between records the ex-date applies from the next record on
+		{"between records", []DividendRec{{ExDate: testDay(2).Add(12 * time.Hour), Amount: 2}}, []float64{0.98, 0.98, 1, 1}},
+		{"on the first record", []DividendRec{{ExDate: testDay(1), Amount: 2}}, []float64{1, 1, 1, 1}},
+		{"before the first record", []DividendRec{{ExDate: testDay(1).AddDate(0, 0, -5), Amount: 2}}, []float64{1, 1, 1, 1}},
+		{"after the last record", []DividendRec{{ExDate: testDay(10), Amount: 2}}, []float64{1, 1, 1, 1}},
+		{"dividend equal to price", []DividendRec{{ExDate: testDay(3), Amount: 100}}, []float64{1, 1, 1, 1}},
+		{"dividend above price", []DividendRec{{ExDate: testDay(3), Amount: 150}}, []float64{1, 1, 1, 1}},
+		{"zero amount", []DividendRec{{ExDate: testDay(3)}}, []float64{1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		if got := TotalReturnFactors(hist, tt.divs); !sameFactors(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
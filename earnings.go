@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// number of past earnings intervals used to estimate the reporting cadence
+const EARNINGSCADENCEWINDOW int = 8
+
+/*
+	Earnings cycle logic:
+	For every stock history day
+	1. find the last earnings strictly before the day and the next earnings on or after the day
+	2. if the calendar has no confirmed next date, project one from the median gap between past reports
+	3. count trading days to each side using the stock history dates (weekdays beyond the known dates)
+	4. phase = days since last / (days since last + days to next). 0 right after a report, 1 on the report day
+	5. every day gets the fields. a side that can't be known (before the first report, no cadence to
+	   project from, no earnings at all) is -1 days, phase is -1 unless both sides are known
+*/
+
+// EARNINGSUNKNOWN is stored for the days and phase that don't apply to a record
+const EARNINGSUNKNOWN = -1
+
+// EarningsCycleEnricher stores the trading day distances to the surrounding reports and the cycle phase
+type EarningsCycleEnricher struct{}
+
+func (EarningsCycleEnricher) Name() string { return "earncycle" }
+
+// 2 writes the unknown values on every record
+func (EarningsCycleEnricher) Version() int { return 2 }
+
+// earnings dates come from mylib2, there is no source to configure
+func (EarningsCycleEnricher) HasSource(opts RunOptions) bool { return true }
+
+func (EarningsCycleEnricher) Inputs() []string { return []string{"datadate"} }
+
+func (EarningsCycleEnricher) Outputs() []string {
+	return []string{"tradingdayssincelastearnings", "tradingdaystonextearnings", "earningscyclephase",
+		"projectednextearningsdate", "nextearningsestimated"}
+}
+
+func (EarningsCycleEnricher) Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error) {
+	var res []EnrichedRec
+
+	var eList []time.Time
+	err := WithRetry(ctx, "earnings for "+symbol, func() (err error) {
+		eList, err = mylib2.GetEarningsForSymbol(symbol, "ALL")
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	if len(eList) == 0 {
+		fmt.Printf("no earnings for %v\n", symbol)
+	}
+	eDates := make([]time.Time, len(eList))
+	copy(eDates, eList)
+	sort.Slice(eDates, func(i, j int) bool {
+		return eDates[i].Before(eDates[j])
+	})
+
+	histDates := make([]time.Time, 0, len(hist))
+	for _, day := range hist {
+		histDates = append(histDates, day.Datadate)
+	}
+
+	for _, day := range hist {
+		last, next, estimated := FindEarningsAround(eDates, day.Datadate)
+		since, to := EARNINGSUNKNOWN, EARNINGSUNKNOWN
+		phase := float64(EARNINGSUNKNOWN)
+		var projected interface{}
+		if !last.IsZero() {
+			since = TradingDaysBetween(histDates, last, day.Datadate)
+		}
+		if !next.IsZero() {
+			to = TradingDaysBetween(histDates, day.Datadate, next)
+			projected = next
+		}
+		if !last.IsZero() && !next.IsZero() {
+			phase = 0
+			if since+to > 0 {
+				phase = float64(since) / float64(since+to)
+			}
+		}
+		res = append(res, EnrichedRec{Datadate: day.Datadate, Fields: bson.D{{Key: "tradingdayssincelastearnings", Value: since},
+			{Key: "tradingdaystonextearnings", Value: to},
+			{Key: "earningscyclephase", Value: phase},
+			{Key: "projectednextearningsdate", Value: projected},
+			{Key: "nextearningsestimated", Value: estimated}}})
+	}
+	return res, nil
+}
+
+// FindEarningsAround returns the last earnings strictly before histdate and the next one on or after it.
+// When there is no confirmed next date it is projected from the historical cadence and estimated is true.
+// eDates must be sorted oldest first
+func FindEarningsAround(eDates []time.Time, histdate time.Time) (last time.Time, next time.Time, estimated bool) {
+	idx := sort.Search(len(eDates), func(i int) bool {
+		return !eDates[i].Before(histdate)
+	})
+	if idx > 0 {
+		last = eDates[idx-1]
+	}
+	if idx < len(eDates) {
+		next = eDates[idx]
+		return last, next, false
+	}
+	cadence := EarningsCadence(eDates)
+	if cadence == 0 || last.IsZero() {
+		return last, next, false
+	}
+	next = last.AddDate(0, 0, cadence)
+	for next.Before(histdate) {
+		next = next.AddDate(0, 0, cadence)
+	}
+	return last, next, true
+}
+
+// EarningsCadence is the median number of calendar days between the most recent reports. 0 if unknown
+func EarningsCadence(eDates []time.Time) int {
+	var gaps []int
+
+	start := len(eDates) - EARNINGSCADENCEWINDOW - 1
+	if start < 0 {
+		start = 0
+	}
+	for i := start + 1; i < len(eDates); i++ {
+		gap := int(eDates[i].Sub(eDates[i-1]).Hours() / 24)
+		if gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	sort.Ints(gaps)
+	return gaps[len(gaps)/2]
+}
+
+// TradingDaysBetween counts trading days in (from, to]. Known trading dates come from dates (sorted oldest first),
+// anything outside of that range is approximated with weekdays. Negative when to is before from
+func TradingDaysBetween(dates []time.Time, from time.Time, to time.Time) int {
+	if to.Before(from) {
+		return -TradingDaysBetween(dates, to, from)
+	}
+	if len(dates) == 0 {
+		return WeekdaysBetween(from, to)
+	}
+	lo := sort.Search(len(dates), func(i int) bool {
+		return dates[i].After(from)
+	})
+	hi := sort.Search(len(dates), func(i int) bool {
+		return dates[i].After(to)
+	})
+	count := hi - lo
+
+	first := dates[0]
+	last := dates[len(dates)-1]
+	if from.Before(first) {
+		end := to
+		if !to.Before(first) {
+			end = first.AddDate(0, 0, -1)
+		}
+		count += WeekdaysBetween(from, end)
+	}
+	if to.After(last) {
+		start := from
+		if start.Before(last) {
+			start = last
+		}
+		count += WeekdaysBetween(start, to)
+	}
+	return count
+}
+
+// WeekdaysBetween counts Monday to Friday days in (from, to]
+func WeekdaysBetween(from time.Time, to time.Time) int {
+	var count int
+
+	for d := from.AddDate(0, 0, 1); !d.After(to); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			count++
+		}
+	}
+	return count
+}
+
+// EarningsSurprise holds the signed surprises of one report and where they rank
+// against the symbol's own earlier reports
+type EarningsSurprise struct {
+	Date              time.Time
+	EpsSurprise       float64
+	HasEps            bool
+	RevenueSurprise   float64
+	HasRevenue        bool
+	Streak            int
+	EpsPercentile     float64
+	RevenuePercentile float64
+	StreakPercentile  float64
+}
+
+/*
+	Surprise logic:
+	LastEarningsSurprise (set in GetEarnings) is the absolute EPS surprise and is left as is.
+	Here we keep the sign so beats and misses can be told apart.
+	1. surprise = (actual - estimate) / |estimate| for EPS and, when present, revenue
+	2. streak counts consecutive EPS beats (positive) or misses (negative)
+	3. percentiles rank each report against the reports before it, so there is no look ahead
+	4. every stock history day gets the values of the last report strictly before it
+*/
+
+// EarningsSurpriseEnricher stores the signed surprises of the last report, the streak and their percentiles
+type EarningsSurpriseEnricher struct{}
+
+func (EarningsSurpriseEnricher) Name() string { return "surprise" }
+
+func (EarningsSurpriseEnricher) Version() int { return 1 }
+
+func (EarningsSurpriseEnricher) HasSource(opts RunOptions) bool { return true }
+
+func (EarningsSurpriseEnricher) Inputs() []string { return []string{"datadate"} }
+
+func (EarningsSurpriseEnricher) Outputs() []string {
+	return []string{"epssurprise", "epssurprisepercentile", "surprisestreak", "surprisestreakpercentile",
+		"revenuesurprise", "revenuesurprisepercentile"}
+}
+
+func (EarningsSurpriseEnricher) Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error) {
+	var res []EnrichedRec
+
+	var eList []time.Time
+	err := WithRetry(ctx, "earnings for "+symbol, func() (err error) {
+		eList, err = mylib2.GetEarningsForSymbol(symbol, "ALL")
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	if len(eList) == 0 {
+		fmt.Printf("no earnings for %v. skipping symbol\n", symbol)
+		return res, nil
+	}
+	surprises := CalcEarningsSurprises(symbol, eList)
+
+	for _, day := range hist {
+		idx := sort.Search(len(surprises), func(i int) bool {
+			return !surprises[i].Date.Before(day.Datadate)
+		})
+		if idx == 0 {
+			continue
+		}
+		s := surprises[idx-1]
+		if !s.HasEps {
+			continue
+		}
+		fields := bson.D{{Key: "epssurprise", Value: s.EpsSurprise},
+			{Key: "epssurprisepercentile", Value: s.EpsPercentile},
+			{Key: "surprisestreak", Value: s.Streak},
+			{Key: "surprisestreakpercentile", Value: s.StreakPercentile}}
+		if s.HasRevenue {
+			fields = append(fields, bson.E{Key: "revenuesurprise", Value: s.RevenueSurprise},
+				bson.E{Key: "revenuesurprisepercentile", Value: s.RevenuePercentile})
+		}
+		res = append(res, EnrichedRec{Datadate: day.Datadate, Fields: fields})
+	}
+	return res, nil
+}
+
+// CalcEarningsSurprises returns one entry per report date, oldest first
+func CalcEarningsSurprises(symbol string, eList []time.Time) []EarningsSurprise {
+	eDates := make([]time.Time, len(eList))
+	copy(eDates, eList)
+	sort.Slice(eDates, func(i, j int) bool {
+		return eDates[i].Before(eDates[j])
+	})
+	eRecs := make([]mylib2.EarningsRec, len(eDates))
+	for i, eDate := range eDates {
+		_, eRecs[i] = mylib2.GetOneEarningsRec(symbol, eDate)
+	}
+	return RankEarningsSurprises(eDates, eRecs)
+}
+
+// RankEarningsSurprises computes the surprises, streaks and percentiles of the reports in eRecs.
+// eDates holds their dates, oldest first
+func RankEarningsSurprises(eDates []time.Time, eRecs []mylib2.EarningsRec) []EarningsSurprise {
+	var res []EarningsSurprise
+	var epsList []float64
+	var revList []float64
+	var streakList []float64
+
+	streak := 0
+	for i, eDate := range eDates {
+		s := EarningsSurprise{Date: eDate}
+		eRec := eRecs[i]
+		if eRec.EpsEstimated != 0 {
+			s.EpsSurprise = (eRec.Eps - eRec.EpsEstimated) / math.Abs(eRec.EpsEstimated)
+			s.HasEps = true
+		}
+		if eRec.RevenueEstimated != 0 && eRec.Revenue != 0 {
+			s.RevenueSurprise = (eRec.Revenue - eRec.RevenueEstimated) / math.Abs(eRec.RevenueEstimated)
+			s.HasRevenue = true
+		}
+		if s.HasEps {
+			switch {
+			case s.EpsSurprise > 0:
+				if streak > 0 {
+					streak++
+				} else {
+					streak = 1
+				}
+			case s.EpsSurprise < 0:
+				if streak < 0 {
+					streak--
+				} else {
+					streak = -1
+				}
+			default:
+				streak = 0
+			}
+			s.Streak = streak
+			epsList = append(epsList, s.EpsSurprise)
+			streakList = append(streakList, float64(s.Streak))
+			s.EpsPercentile = MyPercentile(epsList, s.EpsSurprise)
+			s.StreakPercentile = MyPercentile(streakList, float64(s.Streak))
+		}
+		if s.HasRevenue {
+			revList = append(revList, s.RevenueSurprise)
+			s.RevenuePercentile = MyPercentile(revList, s.RevenueSurprise)
+		}
+		res = append(res, s)
+	}
+	return res
+}
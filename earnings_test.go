@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"mylib2"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func dates(s ...string) []time.Time {
+	var res []time.Time
+	for _, d := range s {
+		res = append(res, date(d))
+	}
+	return res
+}
+
+func TestTradingDaysBetween(t *testing.T) {
+	// Wednesday 2024-03-06 is a holiday
+	known := dates("2024-03-04", "2024-03-05", "2024-03-07", "2024-03-08", "2024-03-11")
+	tests := []struct {
+		name     string
+		dates    []time.Time
+		from, to string
+		want     int
+	}{
+		{"known dates", known, "2024-03-04", "2024-03-08", 3},
+		{"backwards", known, "2024-03-08", "2024-03-04", -3},
+		{"same day", known, "2024-03-07", "2024-03-07", 0},
+		{"past the last date", known, "2024-03-08", "2024-03-13", 3},
+		{"before the first date", known, "2024-02-29", "2024-03-05", 3},
+		{"all before the first date", known, "2024-02-26", "2024-03-01", 4},
+		{"all after the last date", known, "2024-03-15", "2024-03-18", 1},
+		{"no dates", nil, "2024-03-01", "2024-03-04", 1},
+	}
+	for _, tt := range tests {
+		if got := TradingDaysBetween(tt.dates, date(tt.from), date(tt.to)); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindEarningsAround(t *testing.T) {
+	quarterly := dates("2023-05-01", "2023-08-01", "2023-11-01", "2024-02-01")
+	tests := []struct {
+		name      string
+		eDates    []time.Time
+		day       string
+		last      string
+		next      string
+		estimated bool
+	}{
+		{"between reports", quarterly, "2023-09-15", "2023-08-01", "2023-11-01", false},
+		{"report day", quarterly, "2023-11-01", "2023-08-01", "2023-11-01", false},
+		{"before the first report", quarterly, "2023-04-01", "", "2023-05-01", false},
+		{"projected", quarterly, "2024-03-15", "2024-02-01", "2024-05-03", true},
+		{"projected two cycles out", quarterly, "2024-06-01", "2024-02-01", "2024-08-03", true},
+		{"no cadence", dates("2024-02-01"), "2024-03-15", "2024-02-01", "", false},
+		{"no reports", nil, "2024-03-15", "", "", false},
+	}
+	for _, tt := range tests {
+		last, next, estimated := FindEarningsAround(tt.eDates, date(tt.day))
+		if got := formatDate(last); got != tt.last {
+			t.Errorf("%v: last %v, want %v", tt.name, got, tt.last)
+		}
+		if got := formatDate(next); got != tt.next {
+			t.Errorf("%v: next %v, want %v", tt.name, got, tt.next)
+		}
+		if estimated != tt.estimated {
+			t.Errorf("%v: estimated %v, want %v", tt.name, estimated, tt.estimated)
+		}
+	}
+}
+
+func formatDate(d time.Time) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format("2006-01-02")
+}
+
+func TestEarningsCadence(t *testing.T) {
+	// nine monthly reports, then quarterly ones. only the last EARNINGSCADENCEWINDOW gaps count
+	var changed []time.Time
+	d := date("2020-01-01")
+	for i := 0; i < 10; i++ {
+		changed = append(changed, d)
+		d = d.AddDate(0, 0, 30)
+	}
+	d = changed[len(changed)-1]
+	for i := 0; i < 8; i++ {
+		d = d.AddDate(0, 0, 91)
+		changed = append(changed, d)
+	}
+	tests := []struct {
+		name   string
+		eDates []time.Time
+		want   int
+	}{
+		{"no reports", nil, 0},
+		{"one report", dates("2024-02-01"), 0},
+		{"median", dates("2023-01-01", "2023-04-01", "2023-06-30", "2023-10-08"), 90},
+		{"same day twice", dates("2023-01-01", "2023-01-01"), 0},
+		{"recent cadence wins", changed, 91},
+	}
+	for _, tt := range tests {
+		if got := EarningsCadence(tt.eDates); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRankEarningsSurprises(t *testing.T) {
+	eDates := dates("2023-02-01", "2023-05-01", "2023-08-01", "2023-11-01", "2024-02-01", "2024-05-01")
+	eRecs := []mylib2.EarningsRec{
+		{Eps: 1.1, EpsEstimated: 1},
+		{Eps: 1.2, EpsEstimated: 1, Revenue: 110, RevenueEstimated: 100},
+		{Eps: 0.9, EpsEstimated: 1, Revenue: 90, RevenueEstimated: 100},
+		// no estimate: no surprise and the streak carries over
+		{Eps: 1},
+		// a smaller loss than expected is a beat
+		{Eps: -0.5, EpsEstimated: -1},
+		{Eps: 1, EpsEstimated: 1},
+	}
+	tests := []struct {
+		eps, epsPct     float64
+		hasEps          bool
+		streak          int
+		streakPct       float64
+		revenue, revPct float64
+		hasRevenue      bool
+	}{
+		{0.1, 0, true, 1, 0, 0, 0, false},
+		{0.2, 0.5, true, 2, 0.5, 0.1, 0, true},
+		{-0.1, 0, true, -1, 0, -0.1, 0, true},
+		{0, 0, false, 0, 0, 0, 0, false},
+		{0.5, 0.75, true, 1, 0.25, 0, 0, false},
+		{0, 0.2, true, 0, 0.2, 0, 0, false},
+	}
+	got := RankEarningsSurprises(eDates, eRecs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %v surprises, want %v", len(got), len(tests))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for i, tt := range tests {
+		s := got[i]
+		if !s.Date.Equal(eDates[i]) || s.HasEps != tt.hasEps || s.HasRevenue != tt.hasRevenue || s.Streak != tt.streak ||
+			!near(s.EpsSurprise, tt.eps) || !near(s.EpsPercentile, tt.epsPct) || !near(s.StreakPercentile, tt.streakPct) ||
+			!near(s.RevenueSurprise, tt.revenue) || !near(s.RevenuePercentile, tt.revPct) {
+			t.Errorf("report %v: got %+v, want %+v", i, s, tt)
+		}
+	}
+}
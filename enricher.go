@@ -0,0 +1,119 @@
+package main
+
+/*
+	Enrichers:
+	New StockHistory metadata is added by implementing Enricher and listing it in StepRegistry
+	with EnricherStep. RunEnricher does the rest: it loads the symbol's history (including the
+	tickers it replaced), hands it to Compute, keeps the results to the symbol's own records in
+	the run's date range, checks the fields against Outputs and bulk writes them.
+*/
+import (
+	"context"
+	"fmt"
+	"mylib2"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Enricher computes new fields for the records of one symbol
+type Enricher interface {
+	// Name is the step name used with -steps
+	Name() string
+	// Inputs are the record fields Compute reads
+	Inputs() []string
+	// Outputs are the record fields Compute may write. Anything else is rejected
+	Outputs() []string
+	// Version is stamped on every record written. Bump it when Compute changes so recompute finds the old values
+	Version() int
+	// HasSource tells if the data Compute needs is configured in opts. Without it the step has
+	// nothing to do and nothing is stamped
+	HasSource(opts RunOptions) bool
+	// Compute gets the history oldest first and returns the fields to set per date.
+	// Returning no records is fine when there is nothing to add (e.g. no source data)
+	Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error)
+}
+
+// EnrichedRec is the output of an Enricher for one date
+type EnrichedRec struct {
+	Datadate time.Time
+	Fields   bson.D
+}
+
+// EnricherStep wraps an Enricher as a pipeline step
+func EnricherStep(e Enricher, dependsOn ...string) Step {
+	return Step{
+		Name:      e.Name(),
+		DependsOn: dependsOn,
+		Enricher:  e,
+		Version:   e.Version(),
+		Outputs:   e.Outputs(),
+		Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+			return RunEnricher(ctx, e, symbol, opts)
+		},
+	}
+}
+
+// RunEnricher loads, computes and writes one enricher for one symbol. It returns the records changed
+func RunEnricher(ctx context.Context, e Enricher, symbol string, opts RunOptions) (int64, error) {
+	fmt.Printf("Running %v for %v\n", e.Name(), symbol)
+	if !e.HasSource(opts) {
+		return 0, fmt.Errorf("%v has no source configured: %w", e.Name(), ErrNothingToDo)
+	}
+	hist, err := GetLinkedStockHistory(ctx, symbol)
+	if err != nil {
+		return 0, fmt.Errorf("%v failed for %v: %w", e.Name(), symbol, err)
+	}
+	if len(hist) == 0 {
+		fmt.Printf("no stock history for %v. skipping symbol\n", symbol)
+		return 0, nil
+	}
+	own := make(map[time.Time]bool)
+	for _, h := range hist {
+		if h.Underlying == symbol {
+			own[h.Datadate] = true
+		}
+	}
+	recs, err := e.Compute(ctx, symbol, hist, opts)
+	if err != nil {
+		return 0, fmt.Errorf("%v failed for %v: %w", e.Name(), symbol, err)
+	}
+
+	allowed := make(map[string]bool)
+	for _, f := range e.Outputs() {
+		allowed[f] = true
+	}
+	// splits, dividends and new earnings change old days too, so every day in the range is written.
+	// days that didn't change cost nothing
+	bulk := NewBulkUpdater("StockHistory")
+	bulk.Step = e.Name()
+	for _, rec := range recs {
+		if !own[rec.Datadate] || !opts.Range.Contains(rec.Datadate) || len(rec.Fields) == 0 {
+			continue
+		}
+		for _, f := range rec.Fields {
+			if !allowed[f.Key] {
+				return bulk.Modified, fmt.Errorf("%v wrote undeclared field %v for %v", e.Name(), f.Key, symbol)
+			}
+		}
+		filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "datadate", Value: rec.Datadate}}
+		update := bson.D{{Key: "$set", Value: append(rec.Fields, AlgoVersion(e.Name(), e.Version()))}}
+		if err := bulk.Add(ctx, filter, update); err != nil {
+			return bulk.Modified, fmt.Errorf("%v failed writing %v: %w", e.Name(), symbol, err)
+		}
+	}
+	if err := bulk.Flush(ctx); err != nil {
+		return bulk.Modified, fmt.Errorf("%v failed writing %v: %w", e.Name(), symbol, err)
+	}
+	if err := StampEvaluated(ctx, e.Name(), e.Version(), symbol, opts.Range); err != nil {
+		return bulk.Modified, fmt.Errorf("%v failed stamping %v: %w", e.Name(), symbol, err)
+	}
+	fmt.Printf("%v: updated %v records for %v\n", e.Name(), bulk.Modified, symbol)
+	return bulk.Modified, nil
+}
+
+// DescribeEnricher is a one line summary for the step listing
+func DescribeEnricher(e Enricher) string {
+	return fmt.Sprintf("reads %v, writes %v", strings.Join(e.Inputs(), ","), strings.Join(e.Outputs(), ","))
+}
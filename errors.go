@@ -0,0 +1,59 @@
+package main
+
+/*
+	Pipeline errors: data problems are returned up to ProcessSymbol instead of stopping the
+	process, so one bad symbol fails on its own and -onerror decides what the run does next.
+*/
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoEarnings    = errors.New("can't read earnings")
+	ErrNoTrendDates  = errors.New("can't read existing stock history dates")
+	ErrNoExpirations = errors.New("can't read expirations")
+	ErrNoOptions     = errors.New("can't read option chain")
+	ErrNoHistory     = errors.New("can't read stock history")
+	ErrUpdateFailed  = errors.New("stock history updates did not match")
+	ErrInterrupted   = errors.New("run interrupted")
+	ErrRunAborted    = errors.New("run aborted")
+	ErrLocked        = errors.New("lock is held")
+	ErrLeaseLost     = errors.New("lock lost")
+)
+
+// -onerror policies
+const (
+	ONERRORSKIP  = "skip"
+	ONERRORRETRY = "retry"
+	ONERRORABORT = "abort"
+)
+
+// PipelineError ties an error to the symbol, step and (when known) date it happened on
+type PipelineError struct {
+	Symbol string
+	Step   string
+	Date   time.Time
+	Err    error
+}
+
+func (e *PipelineError) Error() string {
+	msg := e.Symbol
+	if e.Step != "" {
+		msg += " " + e.Step
+	}
+	if !e.Date.IsZero() {
+		msg += " " + e.Date.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%v: %v", msg, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// ValidOnError checks the -onerror flag
+func ValidOnError(policy string) bool {
+	return policy == ONERRORSKIP || policy == ONERRORRETRY || policy == ONERRORABORT
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FundamentalsRec is one dated fundamentals observation for a symbol. Zero means not reported
+type FundamentalsRec struct {
+	Symbol    string    `bson:"symbol"`
+	Date      time.Time `bson:"date"`
+	DCF       float64   `bson:"dcf"`
+	PE        float64   `bson:"pe"`
+	EVEBITDA  float64   `bson:"evebitda"`
+	MarketCap float64   `bson:"marketcap"`
+}
+
+// FundamentalsSource provides the fundamentals history of a symbol, in any order
+type FundamentalsSource interface {
+	GetFundamentals(symbol string) ([]FundamentalsRec, error)
+}
+
+// NewFundamentalsSource picks the source for the -fundamentals flag: "mongo" or a path to a json file
+func NewFundamentalsSource(spec string) (FundamentalsSource, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "mongo":
+		return MongoFundamentalsSource{Collection: "Fundamentals"}, nil
+	default:
+		return NewFileFundamentalsSource(spec)
+	}
+}
+
+// MongoFundamentalsSource reads fundamentals loaded into a collection by the data feeds
+type MongoFundamentalsSource struct {
+	Collection string
+}
+
+func (s MongoFundamentalsSource) GetFundamentals(symbol string) ([]FundamentalsRec, error) {
+	return FindSymbolSorted[FundamentalsRec](context.TODO(), s.Collection, symbol, "date")
+}
+
+// FileFundamentalsSource serves fundamentals from a json file, a stand-in for the real feed
+// in tests and ad hoc runs. The file is an array of
+// {"symbol": "AAPL", "date": "2024-03-01", "dcf": 150.2, "pe": 28.1, "evebitda": 21.4, "marketcap": 2.6e12}
+type FileFundamentalsSource struct {
+	Path string
+	recs map[string][]FundamentalsRec
+}
+
+type fileFundamentalsRec struct {
+	Symbol    string  `json:"symbol"`
+	Date      string  `json:"date"`
+	DCF       float64 `json:"dcf"`
+	PE        float64 `json:"pe"`
+	EVEBITDA  float64 `json:"evebitda"`
+	MarketCap float64 `json:"marketcap"`
+}
+
+func (r fileFundamentalsRec) symbolDate() (string, string) { return r.Symbol, r.Date }
+
+func NewFileFundamentalsSource(path string) (*FileFundamentalsSource, error) {
+	recs, err := ReadDatedFile(path, func(r fileFundamentalsRec, d time.Time) FundamentalsRec {
+		return FundamentalsRec{Symbol: r.Symbol, Date: d, DCF: r.DCF, PE: r.PE, EVEBITDA: r.EVEBITDA, MarketCap: r.MarketCap}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FileFundamentalsSource{Path: path, recs: recs}, nil
+}
+
+func (s *FileFundamentalsSource) GetFundamentals(symbol string) ([]FundamentalsRec, error) {
+	return s.recs[symbol], nil
+}
+
+// FundamentalsEnricher stamps each stock history day with the latest known value of every
+// fundamentals field. Fields are forward filled on their own since feeds report them at different times.
+// They live in a fundamentals subdocument, the top level dcf is the older fmplib value
+type FundamentalsEnricher struct{}
+
+func (FundamentalsEnricher) Name() string { return "fundamentals" }
+
+// 2 moved the fields under fundamentals
+func (FundamentalsEnricher) Version() int { return 2 }
+
+func (FundamentalsEnricher) HasSource(opts RunOptions) bool { return opts.Fundamentals != nil }
+
+func (FundamentalsEnricher) Inputs() []string { return []string{"datadate"} }
+
+func (FundamentalsEnricher) Outputs() []string {
+	return []string{"fundamentals.dcf", "fundamentals.pe", "fundamentals.evebitda", "fundamentals.marketcap", "fundamentals.date"}
+}
+
+func (FundamentalsEnricher) Compute(ctx context.Context, symbol string, hist []mylib2.StockHistory, opts RunOptions) ([]EnrichedRec, error) {
+	var res []EnrichedRec
+
+	if opts.Fundamentals == nil {
+		return res, nil
+	}
+	recs, err := opts.Fundamentals.GetFundamentals(symbol)
+	if err != nil {
+		return res, err
+	}
+	if len(recs) == 0 {
+		fmt.Printf("no fundamentals for %v. skipping symbol\n", symbol)
+		return res, nil
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Date.Before(recs[j].Date)
+	})
+
+	var current FundamentalsRec
+	r := 0
+	for _, day := range hist {
+		for r < len(recs) && !recs[r].Date.After(day.Datadate) {
+			current.Date = recs[r].Date
+			if recs[r].DCF != 0 {
+				current.DCF = recs[r].DCF
+			}
+			if recs[r].PE != 0 {
+				current.PE = recs[r].PE
+			}
+			if recs[r].EVEBITDA != 0 {
+				current.EVEBITDA = recs[r].EVEBITDA
+			}
+			if recs[r].MarketCap != 0 {
+				current.MarketCap = recs[r].MarketCap
+			}
+			r++
+		}
+		if current.Date.IsZero() {
+			continue
+		}
+		res = append(res, EnrichedRec{Datadate: day.Datadate, Fields: bson.D{{Key: "fundamentals.dcf", Value: current.DCF},
+			{Key: "fundamentals.pe", Value: current.PE},
+			{Key: "fundamentals.evebitda", Value: current.EVEBITDA},
+			{Key: "fundamentals.marketcap", Value: current.MarketCap},
+			{Key: "fundamentals.date", Value: current.Date}}})
+	}
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"mylib2"
+	"testing"
+	"time"
+)
+
+func TestFundamentalsCompute(t *testing.T) {
+	src, err := NewFileFundamentalsSource("testdata/fundamentals.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	var hist []mylib2.StockHistory
+	for _, d := range []string{"2024-02-29", "2024-03-01", "2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07"} {
+		hist = append(hist, mylib2.StockHistory{Underlying: "AAPL", Datadate: day(d)})
+	}
+	recs, err := FundamentalsEnricher{}.Compute(context.Background(), "AAPL", hist, RunOptions{Fundamentals: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[time.Time]map[string]interface{})
+	for _, r := range recs {
+		got[r.Datadate] = r.Fields.Map()
+	}
+
+	tests := []struct {
+		date      string
+		dcf       float64
+		pe        float64
+		evebitda  float64
+		marketcap float64
+		obsdate   string
+	}{
+		{"2024-03-01", 150.2, 28.1, 0, 2.6e12, "2024-03-01"},
+		{"2024-03-04", 150.2, 28.1, 0, 2.6e12, "2024-03-01"},
+		// only pe reported, the other fields carry forward
+		{"2024-03-05", 150.2, 27.5, 0, 2.6e12, "2024-03-05"},
+		{"2024-03-06", 150.2, 27.5, 0, 2.6e12, "2024-03-05"},
+		{"2024-03-07", 150.2, 27.5, 21.4, 2.7e12, "2024-03-07"},
+	}
+	if _, ok := got[day("2024-02-29")]; ok {
+		t.Errorf("2024-02-29 is before the first observation and should not be written")
+	}
+	if len(recs) != len(tests) {
+		t.Errorf("got %v records, want %v", len(recs), len(tests))
+	}
+	for _, tt := range tests {
+		f, ok := got[day(tt.date)]
+		if !ok {
+			t.Errorf("%v: no record", tt.date)
+			continue
+		}
+		want := map[string]interface{}{"fundamentals.dcf": tt.dcf, "fundamentals.pe": tt.pe, "fundamentals.evebitda": tt.evebitda,
+			"fundamentals.marketcap": tt.marketcap, "fundamentals.date": day(tt.obsdate)}
+		for k, v := range want {
+			if f[k] != v {
+				t.Errorf("%v: %v = %v, want %v", tt.date, k, f[k], v)
+			}
+		}
+	}
+}
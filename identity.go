@@ -0,0 +1,158 @@
+package main
+
+/*
+	Symbol identity:
+	StockHistory is keyed by "underlying" so a ticker change starts a brand new history.
+	SymbolIdentity keeps one document per ticker that links it to the ticker it replaced
+	(and the one that replaced it) so history based windows can read across the rename.
+	Delisted tickers are kept with active=false and are skipped by the runs.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const IDENTITYCOLLECTION = "SymbolIdentity"
+
+// SymbolIdentity links a ticker to its predecessor and successor. ChangeDate is the first
+// trading day under Symbol, RenameDate the first trading day under NewSymbol
+type SymbolIdentity struct {
+	Symbol         string    `bson:"symbol"`
+	PreviousSymbol string    `bson:"previoussymbol"`
+	ChangeDate     time.Time `bson:"changedate"`
+	NewSymbol      string    `bson:"newsymbol"`
+	RenameDate     time.Time `bson:"renamedate"`
+	Active         bool      `bson:"active"`
+	DelistedDate   time.Time `bson:"delisteddate"`
+}
+
+// GetSymbolIdentity returns the identity of symbol. Unknown symbols are active with no predecessor
+func GetSymbolIdentity(symbol string) (SymbolIdentity, error) {
+	var res SymbolIdentity
+
+	coll := mylib2.GetCollection(IDENTITYCOLLECTION)
+	err := coll.FindOne(context.TODO(), bson.D{{Key: "symbol", Value: symbol}}).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return SymbolIdentity{Symbol: symbol, Active: true}, nil
+	}
+	return res, err
+}
+
+// RecordRename links oldSymbol to newSymbol starting on date and marks the old ticker inactive
+func RecordRename(oldSymbol string, newSymbol string, date time.Time) error {
+	coll := mylib2.GetCollection(IDENTITYCOLLECTION)
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(context.TODO(), bson.D{{Key: "symbol", Value: oldSymbol}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "newsymbol", Value: newSymbol},
+			{Key: "renamedate", Value: date},
+			{Key: "active", Value: false}}}}, opts)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(context.TODO(), bson.D{{Key: "symbol", Value: newSymbol}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "previoussymbol", Value: oldSymbol},
+			{Key: "changedate", Value: date},
+			{Key: "active", Value: true}}}}, opts)
+	return err
+}
+
+// RecordDelisting marks symbol inactive as of date
+func RecordDelisting(symbol string, date time.Time) error {
+	coll := mylib2.GetCollection(IDENTITYCOLLECTION)
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(context.TODO(), bson.D{{Key: "symbol", Value: symbol}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "active", Value: false},
+			{Key: "delisteddate", Value: date}}}}, opts)
+	return err
+}
+
+// GetSymbolIdentities returns the identities of symbols by symbol in one read. Unknown symbols are
+// active with no predecessor
+func GetSymbolIdentities(ctx context.Context, symbols []string) (map[string]SymbolIdentity, error) {
+	var found []SymbolIdentity
+
+	coll := mylib2.GetCollection(IDENTITYCOLLECTION)
+	err := WithRetry(ctx, "read identities", func() error {
+		cursor, err := coll.Find(ctx, bson.D{{Key: "symbol", Value: bson.M{"$in": symbols}}})
+		if err != nil {
+			return err
+		}
+		found = nil
+		return cursor.All(ctx, &found)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]SymbolIdentity, len(symbols))
+	for _, symbol := range symbols {
+		res[symbol] = SymbolIdentity{Symbol: symbol, Active: true}
+	}
+	for _, id := range found {
+		res[id.Symbol] = id
+	}
+	return res, nil
+}
+
+// ActiveSymbols drops the symbols marked inactive. The selection fails when the identities can't
+// be read, any of the symbols may be delisted
+func ActiveSymbols(symbols []string) ([]string, error) {
+	var res []string
+
+	ids, err := GetSymbolIdentities(context.TODO(), symbols)
+	if err != nil {
+		return nil, fmt.Errorf("can't read symbol identities: %w", err)
+	}
+	for _, symbol := range symbols {
+		id := ids[symbol]
+		if !id.Active {
+			fmt.Printf("%v is inactive (renamed to %v, delisted %v). skipping symbol\n", symbol, id.NewSymbol,
+				id.DelistedDate.Format("2006-01-02"))
+			continue
+		}
+		res = append(res, symbol)
+	}
+	return res, nil
+}
+
+// GetLinkedStockHistory returns the stock history of symbol preceded by the history of the tickers
+// it replaced, oldest first. extra narrows the filter further. Records keep their own underlying
+// so callers can tell them apart
+func GetLinkedStockHistory(ctx context.Context, symbol string, extra ...bson.E) ([]mylib2.StockHistory, error) {
+	filter := append(bson.D{{Key: "underlying", Value: symbol}}, extra...)
+	res, err := FindStockHistory(ctx, filter)
+	if err != nil {
+		return res, err
+	}
+
+	seen := map[string]bool{symbol: true}
+	current := symbol
+	for {
+		id, err := GetSymbolIdentity(current)
+		if err != nil {
+			return res, fmt.Errorf("can't read identity of %v: %w", current, err)
+		}
+		if id.PreviousSymbol == "" || seen[id.PreviousSymbol] {
+			break
+		}
+		filter := append(bson.D{{Key: "underlying", Value: id.PreviousSymbol}, {Key: "datadate", Value: bson.M{"$lt": id.ChangeDate}}}, extra...)
+		prev, err := FindStockHistory(ctx, filter)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, prev...)
+		seen[id.PreviousSymbol] = true
+		current = id.PreviousSymbol
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Datadate.Before(res[j].Datadate)
+	})
+	return res, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+/*
+	Lease locks: a lock is a document in XHistLocks keyed by name. Taking it is one upsert that only
+	matches when the lock is free, expired or already ours, so two runs can't both win. The holder
+	renews the lease while it works. A crashed run's lock expires after LOCKTTL.
+	Full universe runs hold the environment lock (the env name), every run holds env/symbol
+	while a symbol is processed.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylib2"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const LOCKCOLLECTION = "XHistLocks"
+const LOCKTTL = 5 * time.Minute
+
+// LockRec is the stored lock. Owner identifies the worker (run id, host, pid and worker), a resumed
+// run reuses the run id but never the owner of the process it resumes
+type LockRec struct {
+	Name     string    `bson:"_id"`
+	Owner    string    `bson:"owner"`
+	RunID    string    `bson:"runid"`
+	Host     string    `bson:"host"`
+	Pid      int       `bson:"pid"`
+	Acquired time.Time `bson:"acquired"`
+	Expires  time.Time `bson:"expires"`
+}
+
+// Lease is a held lock that renews itself until Release. Its context is cancelled when
+// the lock is lost, so the work it protects stops writing
+type Lease struct {
+	Name    string
+	Owner   string
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	expires time.Time
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+func EnvLockName(env string) string {
+	return env
+}
+
+func SymbolLockName(env string, symbol string) string {
+	return env + "/" + symbol
+}
+
+// LeaseOwner is the lock owner of a worker of this process for runID. An empty worker is the process itself
+func LeaseOwner(runID string, worker string) string {
+	host, _ := os.Hostname()
+	if worker == "" {
+		return fmt.Sprintf("%v/%v/%v", runID, host, os.Getpid())
+	}
+	return fmt.Sprintf("%v/%v/%v/%v", runID, host, os.Getpid(), worker)
+}
+
+// AcquireLock takes the named lock for a worker of this process working on runID. When someone else
+// (another worker of this process too) holds it the error wraps ErrLocked and names the holding run
+func AcquireLock(ctx context.Context, name string, runID string, worker string) (*Lease, error) {
+	coll := mylib2.GetCollection(LOCKCOLLECTION)
+	host, _ := os.Hostname()
+	owner := LeaseOwner(runID, worker)
+	now := time.Now()
+
+	filter := bson.D{{Key: "_id", Value: name}, {Key: "$or", Value: bson.A{
+		bson.D{{Key: "owner", Value: owner}},
+		bson.D{{Key: "expires", Value: bson.M{"$lt": now}}}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: owner}, {Key: "runid", Value: runID}, {Key: "host", Value: host},
+		{Key: "pid", Value: os.Getpid()}, {Key: "acquired", Value: now}, {Key: "expires", Value: now.Add(LOCKTTL)}}}}
+	_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// the lock exists and the filter didn't match: it's someone else's and still valid
+		var holder LockRec
+		if ferr := coll.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&holder); ferr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrLocked, name)
+		}
+		return nil, fmt.Errorf("%w: %v by run %v on %v (pid %v) since %v, expires %v", ErrLocked, name, holder.RunID,
+			holder.Host, holder.Pid, holder.Acquired.Format(time.DateTime), holder.Expires.Format(time.DateTime))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{Name: name, Owner: owner, expires: now.Add(LOCKTTL), stop: make(chan struct{})}
+	lease.ctx, lease.cancel = context.WithCancelCause(context.Background())
+	lease.done.Add(1)
+	go lease.keepAlive()
+	return lease, nil
+}
+
+// Context is cancelled with ErrLeaseLost when the lock is lost and when it is released
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// keepAlive pushes the expiry out every third of the ttl. When the lock was taken over, or
+// renewing failed until it expired, the lease context is cancelled
+func (l *Lease) keepAlive() {
+	defer l.done.Done()
+	ticker := time.NewTicker(LOCKTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			coll := mylib2.GetCollection(LOCKCOLLECTION)
+			filter := bson.D{{Key: "_id", Value: l.Name}, {Key: "owner", Value: l.Owner}}
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "expires", Value: time.Now().Add(LOCKTTL)}}}}
+			renewed := time.Now().Add(LOCKTTL)
+			res, err := coll.UpdateOne(context.TODO(), filter, update)
+			switch {
+			case err != nil && time.Now().After(l.expires):
+				fmt.Printf("Lost lock %v: can't renew it before it expired: %v\n", l.Name, err)
+				l.cancel(fmt.Errorf("%w: %v can't be renewed: %v", ErrLeaseLost, l.Name, err))
+				return
+			case err != nil:
+				fmt.Printf("Can't renew lock %v: %v\n", l.Name, err)
+			case res.MatchedCount == 0:
+				fmt.Printf("Lost lock %v: it expired and was taken over\n", l.Name)
+				l.cancel(fmt.Errorf("%w: %v was taken over", ErrLeaseLost, l.Name))
+				return
+			default:
+				l.expires = renewed
+			}
+		}
+	}
+}
+
+// Release stops renewing and removes the lock if we still hold it
+func (l *Lease) Release() error {
+	close(l.stop)
+	l.done.Wait()
+	l.cancel(nil)
+	coll := mylib2.GetCollection(LOCKCOLLECTION)
+	_, err := coll.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: l.Name}, {Key: "owner", Value: l.Owner}})
+	return err
+}
+
+// RunLock returns an unexpired lock held for runID, by any process
+func RunLock(runID string) (LockRec, bool, error) {
+	var res LockRec
+
+	coll := mylib2.GetCollection(LOCKCOLLECTION)
+	filter := bson.D{{Key: "runid", Value: runID}, {Key: "expires", Value: bson.M{"$gt": time.Now()}}}
+	err := coll.FindOne(context.TODO(), filter).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, false, nil
+	}
+	return res, err == nil, err
+}
+
+// ListLocks returns the stored locks, expired ones included
+func ListLocks() ([]LockRec, error) {
+	var res []LockRec
+
+	coll := mylib2.GetCollection(LOCKCOLLECTION)
+	cursor, err := coll.Find(context.TODO(), bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return res, err
+	}
+	err = cursor.All(context.TODO(), &res)
+	return res, err
+}
+
+// BreakLock removes a lock whoever holds it
+func BreakLock(name string) (bool, error) {
+	coll := mylib2.GetCollection(LOCKCOLLECTION)
+	res, err := coll.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: name}})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
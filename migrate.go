@@ -0,0 +1,111 @@
+package main
+
+/*
+	StockHistory schema versions. Every document carries schemaversion, documents written before
+	versioning have none and count as version 0. A migration upgrades documents from From to From+1:
+	1. read a batch of documents at version From, in _id order
+	2. Upgrade returns the fields to $set on each of them, schemaversion is set to From+1 with it
+	3. the update filter repeats the version, so a document changed in between is left for the next pass
+	Progress lives in the documents themselves, an interrupted migrate picks up the rest when run again.
+*/
+import (
+	"context"
+	"fmt"
+	"mylib2"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// STOCKHISTORYSCHEMAVERSION is the version the current code writes
+const STOCKHISTORYSCHEMAVERSION = 1
+const MIGRATIONBATCHSIZE = 1000
+
+type Migration struct {
+	From        int
+	Description string
+	// Upgrade returns the fields to set on doc. nil when only the version changes
+	Upgrade func(doc bson.M) (bson.D, error)
+}
+
+// Migrations is ordered by From and has one entry per version below STOCKHISTORYSCHEMAVERSION
+var Migrations = []Migration{
+	{From: 0, Description: "stamp documents written before schema versioning", Upgrade: func(doc bson.M) (bson.D, error) {
+		return nil, nil
+	}},
+}
+
+// versionFilter matches the documents at version v
+func versionFilter(v int) bson.D {
+	if v == 0 {
+		return bson.D{{Key: "schemaversion", Value: bson.M{"$in": bson.A{nil, 0}}}}
+	}
+	return bson.D{{Key: "schemaversion", Value: v}}
+}
+
+// CountSchemaVersions returns the number of StockHistory documents at each version below the current one
+func CountSchemaVersions(ctx context.Context) (map[int]int64, error) {
+	res := make(map[int]int64)
+	coll := mylib2.GetCollection("StockHistory")
+	for _, m := range Migrations {
+		n, err := coll.CountDocuments(ctx, versionFilter(m.From))
+		if err != nil {
+			return res, err
+		}
+		res[m.From] = n
+	}
+	return res, nil
+}
+
+// RunMigration upgrades every document at m.From. It returns the number of documents upgraded
+// and stops at the first Upgrade error
+func RunMigration(ctx context.Context, m Migration, batchSize int) (int64, error) {
+	var upgraded int64
+	var lastID interface{}
+
+	coll := mylib2.GetCollection("StockHistory")
+	for ctx.Err() == nil {
+		var docs []bson.M
+
+		filter := versionFilter(m.From)
+		if lastID != nil {
+			filter = append(filter, bson.E{Key: "_id", Value: bson.M{"$gt": lastID}})
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(batchSize))
+		err := WithRetry(ctx, "migration batch", func() error {
+			cursor, err := coll.Find(ctx, filter, opts)
+			if err != nil {
+				return err
+			}
+			return cursor.All(ctx, &docs)
+		})
+		if err != nil {
+			return upgraded, err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		bulk := NewBulkUpdater("StockHistory")
+		bulk.Step = "migrate"
+		for _, doc := range docs {
+			lastID = doc["_id"]
+			fields, err := m.Upgrade(doc)
+			if err != nil {
+				bulk.Flush(ctx)
+				return upgraded + bulk.Modified, fmt.Errorf("migration %v to %v of %v %v: %w", m.From, m.From+1, doc["underlying"], lastID, err)
+			}
+			fields = append(fields, bson.E{Key: "schemaversion", Value: m.From + 1})
+			update := bson.D{{Key: "$set", Value: fields}}
+			if err := bulk.Add(ctx, append(bson.D{{Key: "_id", Value: lastID}}, versionFilter(m.From)...), update); err != nil {
+				return upgraded + bulk.Modified, err
+			}
+		}
+		if err := bulk.Flush(ctx); err != nil {
+			return upgraded + bulk.Modified, err
+		}
+		upgraded += bulk.Modified
+		fmt.Printf("Migration %v to %v: %v documents upgraded\n", m.From, m.From+1, upgraded)
+	}
+	return upgraded, ctx.Err()
+}
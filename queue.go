@@ -0,0 +1,300 @@
+package main
+
+/*
+	Queue mode: with -queue=NAME the selected symbols are enqueued as documents in XHistQueue and the
+	workers claim them from there instead of from the in-process channel. Any number of xhist2
+	processes on any number of hosts can work the same queue.
+	1. enqueue is an upsert per (queue, symbol), so every worker can enqueue the same selection. when
+	   nothing of the queue is pending or claimed the last round is over and its done and failed jobs
+	   are reset, so the same queue name can be used night after night. a worker started after the
+	   round finished starts a new one
+	2. claim is one findOneAndUpdate: a pending job, or a claimed job whose visibility timed out
+	3. the claiming worker pushes visibleat forward while it works. a dead worker's job becomes
+	   claimable again once visibleat passes
+	4. a worker stops when nothing is pending or claimed. a job whose visibility ran out after
+	   QUEUEMAXATTEMPTS claims is marked failed instead of being claimed again
+	The selection of the enqueue that started the round (dates, -force, -steps) is stored on the job so all
+	workers build the same records whatever flags they were started with.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const QUEUECOLLECTION = "XHistQueue"
+const QUEUEVISIBILITY = 10 * time.Minute
+const QUEUEPOLL = 15 * time.Second
+const QUEUEMAXATTEMPTS = 5
+
+// queue job statuses
+const (
+	JOBPENDING = "pending"
+	JOBCLAIMED = "claimed"
+	JOBDONE    = "done"
+	JOBFAILED  = "failed"
+)
+
+// QueueSelection is what a job builds: the resolved dates, -from/-to, -force and the -steps names
+type QueueSelection struct {
+	Since    time.Time `bson:"since"`
+	Lookback int       `bson:"lookback"`
+	From     time.Time `bson:"from"`
+	To       time.Time `bson:"to"`
+	Force    bool      `bson:"force"`
+	Steps    []string  `bson:"steps"`
+}
+
+// NewQueueSelection takes the selection from the run options
+func NewQueueSelection(opts RunOptions) QueueSelection {
+	sel := QueueSelection{Since: opts.Since, Lookback: opts.Lookback, From: opts.Range.From, To: opts.Range.To, Force: opts.Force}
+	for _, s := range opts.Steps {
+		sel.Steps = append(sel.Steps, s.Name)
+	}
+	return sel
+}
+
+// Apply returns opts with the job's selection in place of the worker's own
+func (sel QueueSelection) Apply(opts RunOptions) (RunOptions, error) {
+	var err error
+
+	opts.Since = sel.Since
+	opts.Lookback = sel.Lookback
+	opts.Range = DateRange{From: sel.From, To: sel.To}
+	opts.Force = sel.Force
+	opts.Steps, err = ResolveSteps(strings.Join(sel.Steps, ","))
+	return opts, err
+}
+
+// QueueJob is one symbol of a queue
+type QueueJob struct {
+	Queue     string         `bson:"queue"`
+	Symbol    string         `bson:"symbol"`
+	Status    string         `bson:"status"`
+	Selection QueueSelection `bson:"selection"`
+	Owner     string         `bson:"owner"`
+	Attempts  int            `bson:"attempts"`
+	Enqueued  time.Time      `bson:"enqueued"`
+	VisibleAt time.Time      `bson:"visibleat"`
+	Finished  time.Time      `bson:"finished"`
+	Records   int64          `bson:"records"`
+	Error     string         `bson:"error"`
+}
+
+// Queue works the jobs of one queue name. The collection is passed in so a queue can
+// run against any database, e.g. a local mongod
+type Queue struct {
+	Coll       *mongo.Collection
+	Name       string
+	Visibility time.Duration
+}
+
+func NewQueue(coll *mongo.Collection, name string, visibility time.Duration) *Queue {
+	return &Queue{Coll: coll, Name: name, Visibility: visibility}
+}
+
+func (q *Queue) jobFilter(symbol string) bson.D {
+	return bson.D{{Key: "queue", Value: q.Name}, {Key: "symbol", Value: symbol}}
+}
+
+// Enqueue adds the symbols that aren't in the queue yet, starting a new round when the last one is over.
+// It returns how many jobs were added or reset
+func (q *Queue) Enqueue(ctx context.Context, symbols []string, sel QueueSelection) (int64, error) {
+	var models []mongo.WriteModel
+	var reset int64
+
+	now := time.Now()
+	left, err := q.Outstanding(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if left == 0 && len(symbols) > 0 {
+		// jobs finished after now belong to a worker that started the round before us
+		filter := bson.D{{Key: "queue", Value: q.Name}, {Key: "symbol", Value: bson.M{"$in": symbols}},
+			{Key: "status", Value: bson.M{"$in": bson.A{JOBDONE, JOBFAILED}}}, {Key: "finished", Value: bson.M{"$lt": now}}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: JOBPENDING}, {Key: "selection", Value: sel},
+			{Key: "owner", Value: ""}, {Key: "attempts", Value: 0},
+			{Key: "enqueued", Value: now}, {Key: "records", Value: 0}, {Key: "error", Value: ""}}}}
+		err := WithRetry(ctx, "reset queue "+q.Name, func() error {
+			res, err := q.Coll.UpdateMany(ctx, filter, update)
+			if err == nil {
+				reset = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, symbol := range symbols {
+		job := QueueJob{Queue: q.Name, Symbol: symbol, Status: JOBPENDING, Selection: sel, Enqueued: now}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(q.jobFilter(symbol)).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: job}}).SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return reset, nil
+	}
+	res, err := q.Coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return reset, err
+	}
+	return reset + res.UpsertedCount, nil
+}
+
+// Claim hands the next available job to owner. ok is false when nothing can be claimed right now
+func (q *Queue) Claim(ctx context.Context, owner string) (job QueueJob, ok bool, err error) {
+	now := time.Now()
+	if err := q.failExhausted(ctx, now); err != nil {
+		return job, false, err
+	}
+	filter := bson.D{{Key: "queue", Value: q.Name}, {Key: "attempts", Value: bson.M{"$lt": QUEUEMAXATTEMPTS}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "status", Value: JOBPENDING}},
+			bson.D{{Key: "status", Value: JOBCLAIMED}, {Key: "visibleat", Value: bson.M{"$lt": now}}}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: JOBCLAIMED}, {Key: "owner", Value: owner},
+		{Key: "visibleat", Value: now.Add(q.Visibility)}}},
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "enqueued", Value: 1}, {Key: "symbol", Value: 1}}).
+		SetReturnDocument(options.After)
+	err = WithRetry(ctx, "claim from "+q.Name, func() error {
+		return q.Coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return job, false, nil
+	}
+	if err != nil {
+		return job, false, err
+	}
+	return job, true, nil
+}
+
+// failExhausted marks the jobs that timed out on their last attempt failed, they would stay claimed forever
+func (q *Queue) failExhausted(ctx context.Context, now time.Time) error {
+	filter := bson.D{{Key: "queue", Value: q.Name}, {Key: "status", Value: JOBCLAIMED},
+		{Key: "visibleat", Value: bson.M{"$lt": now}}, {Key: "attempts", Value: bson.M{"$gte": QUEUEMAXATTEMPTS}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: JOBFAILED}, {Key: "finished", Value: now},
+		{Key: "error", Value: fmt.Sprintf("gave up after %v attempts", QUEUEMAXATTEMPTS)}}}}
+	return WithRetry(ctx, "fail exhausted jobs of "+q.Name, func() error {
+		_, err := q.Coll.UpdateMany(ctx, filter, update)
+		return err
+	})
+}
+
+// Heartbeat keeps a claimed job invisible to other workers until the returned stop is called
+func (q *Queue) Heartbeat(job QueueJob) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(q.Visibility / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				filter := append(q.jobFilter(job.Symbol), bson.E{Key: "owner", Value: job.Owner})
+				update := bson.D{{Key: "$set", Value: bson.D{{Key: "visibleat", Value: time.Now().Add(q.Visibility)}}}}
+				if _, err := q.Coll.UpdateOne(context.TODO(), filter, update); err != nil {
+					fmt.Printf("Can't extend queue job %v: %v\n", job.Symbol, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Complete stores the outcome of a job. It's a no-op when the job was re-claimed by another worker
+func (q *Queue) Complete(ctx context.Context, job QueueJob, res SymbolResult) error {
+	status := JOBDONE
+	if res.Failed() {
+		status = JOBFAILED
+	}
+	filter := append(q.jobFilter(job.Symbol), bson.E{Key: "owner", Value: job.Owner})
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}, {Key: "finished", Value: time.Now()},
+		{Key: "records", Value: res.Records}, {Key: "error", Value: res.Error}}}}
+	return WithRetry(ctx, "complete "+job.Symbol, func() error {
+		_, err := q.Coll.UpdateOne(ctx, filter, update)
+		return err
+	})
+}
+
+// Outstanding counts the jobs that are pending or claimed and can still be worked
+func (q *Queue) Outstanding(ctx context.Context) (int64, error) {
+	filter := bson.D{{Key: "queue", Value: q.Name}, {Key: "status", Value: bson.M{"$in": bson.A{JOBPENDING, JOBCLAIMED}}},
+		{Key: "attempts", Value: bson.M{"$lt": QUEUEMAXATTEMPTS}}}
+	return q.Coll.CountDocuments(ctx, filter)
+}
+
+// Counts returns the number of jobs by status
+func (q *Queue) Counts(ctx context.Context) (map[string]int64, error) {
+	res := make(map[string]int64)
+	for _, status := range []string{JOBPENDING, JOBCLAIMED, JOBDONE, JOBFAILED} {
+		n, err := q.Coll.CountDocuments(ctx, bson.D{{Key: "queue", Value: q.Name}, {Key: "status", Value: status}})
+		if err != nil {
+			return res, err
+		}
+		res[status] = n
+	}
+	return res, nil
+}
+
+// Purge removes every job of the queue
+func (q *Queue) Purge(ctx context.Context) (int64, error) {
+	res, err := q.Coll.DeleteMany(ctx, bson.D{{Key: "queue", Value: q.Name}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// queueLoader is the queue mode worker: it claims jobs until the queue is drained or the run stops
+func queueLoader(ctx context.Context, q *Queue, results chan<- SymbolResult, opts RunOptions) {
+	for ctx.Err() == nil {
+		job, ok, err := q.Claim(ctx, LeaseOwner(opts.RunID, opts.Worker))
+		if err != nil {
+			fmt.Printf("Can't claim from queue %v: %v\n", q.Name, err)
+			return
+		}
+		if !ok {
+			// other workers may still hold jobs that come back if they die
+			left, err := q.Outstanding(ctx)
+			if err != nil || left == 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(QUEUEPOLL):
+			}
+			continue
+		}
+		jobOpts, err := job.Selection.Apply(opts)
+		if err != nil {
+			// enqueued by a build with other steps
+			res := SymbolResult{Symbol: job.Symbol, Status: STATUSFAILED, Error: err.Error()}
+			if err := q.Complete(context.TODO(), job, res); err != nil {
+				fmt.Printf("Can't complete queue job %v: %v\n", job.Symbol, err)
+			}
+			results <- res
+			continue
+		}
+		stop := q.Heartbeat(job)
+		res := processWithLock(ctx, job.Symbol, jobOpts)
+		stop()
+		if res.Interrupted {
+			// put it back instead of leaving it claimed until the visibility runs out
+			filter := append(q.jobFilter(job.Symbol), bson.E{Key: "owner", Value: job.Owner})
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: JOBPENDING}}}}
+			if _, err := q.Coll.UpdateOne(context.TODO(), filter, update); err != nil {
+				fmt.Printf("Can't release queue job %v: %v\n", job.Symbol, err)
+			}
+		} else if err := q.Complete(context.TODO(), job, res); err != nil {
+			fmt.Printf("Can't complete queue job %v: %v\n", job.Symbol, err)
+		}
+		results <- res
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testQueue connects to the mongod in XHIST2_TEST_MONGODB_URI, e.g. mongodb://localhost:27017,
+// and returns a queue in a fresh collection that is dropped after the test
+func testQueue(t *testing.T, visibility time.Duration) *Queue {
+	uri := os.Getenv("XHIST2_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("XHIST2_TEST_MONGODB_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := client.Database("xhist2test").Collection(fmt.Sprintf("queue%v", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		coll.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return NewQueue(coll, "test", visibility)
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	q := testQueue(t, 200*time.Millisecond)
+	sel := QueueSelection{Lookback: 5, Force: true, Steps: []string{"base"}}
+
+	added, err := q.Enqueue(ctx, []string{"AAA", "BBB"}, sel)
+	if err != nil || added != 2 {
+		t.Fatalf("enqueue: added %v, %v", added, err)
+	}
+	// a second worker joins the round without adding anything
+	if added, err := q.Enqueue(ctx, []string{"AAA", "BBB"}, QueueSelection{}); err != nil || added != 0 {
+		t.Fatalf("second enqueue: added %v, %v", added, err)
+	}
+
+	first, ok, err := q.Claim(ctx, "w1")
+	if err != nil || !ok || first.Symbol != "AAA" || first.Attempts != 1 {
+		t.Fatalf("claim: %+v %v %v", first, ok, err)
+	}
+	if first.Selection.Lookback != 5 || !first.Selection.Force || len(first.Selection.Steps) != 1 {
+		t.Errorf("selection of the first enqueue not kept: %+v", first.Selection)
+	}
+	second, ok, err := q.Claim(ctx, "w2")
+	if err != nil || !ok || second.Symbol != "BBB" {
+		t.Fatalf("claim: %+v %v %v", second, ok, err)
+	}
+	if _, ok, err := q.Claim(ctx, "w3"); err != nil || ok {
+		t.Fatalf("claimed a job that is still visible to its owner: %v %v", ok, err)
+	}
+
+	// both workers die, their jobs come back once the visibility runs out
+	time.Sleep(300 * time.Millisecond)
+	var reclaimed []QueueJob
+	for i := 0; i < 2; i++ {
+		job, ok, err := q.Claim(ctx, "w3")
+		if err != nil || !ok || job.Attempts != 2 {
+			t.Fatalf("re-claim: %+v %v %v", job, ok, err)
+		}
+		reclaimed = append(reclaimed, job)
+	}
+
+	// a late Complete from a dead worker changes nothing
+	if err := q.Complete(ctx, second, SymbolResult{Symbol: "BBB", Status: STATUSFAILED}); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := q.Counts(ctx)
+	if err != nil || counts[JOBCLAIMED] != 2 {
+		t.Fatalf("counts %v %v", counts, err)
+	}
+	for _, job := range reclaimed {
+		if err := q.Complete(ctx, job, SymbolResult{Symbol: job.Symbol, Status: STATUSOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts, err = q.Counts(ctx)
+	if err != nil || counts[JOBDONE] != 2 {
+		t.Fatalf("counts %v %v", counts, err)
+	}
+	if left, err := q.Outstanding(ctx); err != nil || left != 0 {
+		t.Fatalf("outstanding %v %v", left, err)
+	}
+
+	// the round is over, the next enqueue starts a new one
+	if added, err := q.Enqueue(ctx, []string{"AAA", "BBB"}, QueueSelection{Lookback: 1}); err != nil || added != 2 {
+		t.Fatalf("new round: added %v, %v", added, err)
+	}
+	job, ok, err := q.Claim(ctx, "w1")
+	if err != nil || !ok || job.Attempts != 1 || job.Selection.Lookback != 1 {
+		t.Fatalf("new round claim: %+v %v %v", job, ok, err)
+	}
+}
+
+func TestQueueExhausted(t *testing.T) {
+	ctx := context.Background()
+	q := testQueue(t, 10*time.Millisecond)
+
+	if _, err := q.Enqueue(ctx, []string{"AAA"}, QueueSelection{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < QUEUEMAXATTEMPTS; i++ {
+		if _, ok, err := q.Claim(ctx, "w1"); err != nil || !ok {
+			t.Fatalf("claim %v: %v %v", i+1, ok, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, ok, err := q.Claim(ctx, "w1"); err != nil || ok {
+		t.Fatalf("claimed past the attempts limit: %v %v", ok, err)
+	}
+	counts, err := q.Counts(ctx)
+	if err != nil || counts[JOBFAILED] != 1 || counts[JOBCLAIMED] != 0 {
+		t.Fatalf("counts %v %v", counts, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+/*
+	Algorithm versions: every step stamps algoversions.<step> = Step.Version on the records it writes, and
+	on the records it looked at without writing (e.g. the first year of ivpct, days without a rating).
+	When a step's logic changes (e.g. CalcHistVolForPeriod or MyPercentile) its Version is bumped and
+	recompute refreshes only the records that hold values of the step with an older or no stamp:
+	1. per step, group the behind records by symbol with their first and last date
+	2. per symbol, run the behind steps with -force over the span of those dates
+	Steps are recomputed on their own, list dependents in -steps when they should follow a changed input.
+*/
+import (
+	"context"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AlgoVersion is the stamp a step adds to its $set
+func AlgoVersion(step string, version int) bson.E {
+	return bson.E{Key: "algoversions." + step, Value: version}
+}
+
+// StampEvaluated stamps version on the records of symbol in rng (matching extra) that a step looked at
+// but had nothing to write for. Without it those records would look behind forever
+func StampEvaluated(ctx context.Context, step string, version int, symbol string, rng DateRange, extra ...bson.E) error {
+	filter := bson.D{{Key: "underlying", Value: symbol},
+		{Key: "algoversions." + step, Value: bson.M{"$not": bson.M{"$gte": version}}}}
+	dates := bson.M{}
+	if !rng.From.IsZero() {
+		dates["$gte"] = rng.From
+	}
+	if !rng.To.IsZero() {
+		dates["$lte"] = rng.To
+	}
+	if len(dates) > 0 {
+		filter = append(filter, bson.E{Key: "datadate", Value: dates})
+	}
+	filter = append(filter, extra...)
+	update := bson.D{{Key: "$set", Value: bson.D{AlgoVersion(step, version)}}}
+	coll := mylib2.GetCollection("StockHistory")
+	return WithRetry(ctx, "stamp "+step+" version", func() error {
+		_, err := coll.UpdateMany(ctx, filter, update)
+		return err
+	})
+}
+
+// stampAfter wraps a step's result: when the step succeeded the records it evaluated are stamped
+func stampAfter(ctx context.Context, step string, version int, symbol string, rng DateRange, extra ...bson.E) func(int64, error) (int64, error) {
+	return func(n int64, err error) (int64, error) {
+		if err != nil {
+			return n, err
+		}
+		return n, StampEvaluated(ctx, step, version, symbol, rng, extra...)
+	}
+}
+
+// BehindRange is the span of a symbol's records that a step wrote with an older version
+type BehindRange struct {
+	Symbol  string    `bson:"_id"`
+	From    time.Time `bson:"from"`
+	To      time.Time `bson:"to"`
+	Records int64     `bson:"records"`
+}
+
+// FindBehind returns, by symbol, the records step holds values for under an older version. An empty
+// symbols list means every symbol
+func FindBehind(ctx context.Context, step Step, symbols []string) ([]BehindRange, error) {
+	var res []BehindRange
+
+	var written bson.A
+	for _, f := range step.Outputs {
+		written = append(written, bson.D{{Key: f, Value: bson.M{"$exists": true}}})
+	}
+	match := bson.D{{Key: "algoversions." + step.Name, Value: bson.M{"$not": bson.M{"$gte": step.Version}}},
+		{Key: "$or", Value: written}}
+	if len(symbols) > 0 {
+		match = append(match, bson.E{Key: "underlying", Value: bson.M{"$in": symbols}})
+	}
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$underlying"},
+			{Key: "from", Value: bson.M{"$min": "$datadate"}},
+			{Key: "to", Value: bson.M{"$max": "$datadate"}},
+			{Key: "records", Value: bson.M{"$sum": 1}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	coll := mylib2.GetCollection("StockHistory")
+	err := WithRetry(ctx, "find "+step.Name+" records to recompute", func() error {
+		cursor, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &res)
+	})
+	return res, err
+}
+
+// RecomputePlan is what recompute does for one symbol
+type RecomputePlan struct {
+	Symbol  string
+	Steps   []Step
+	Range   DateRange
+	Records int64
+}
+
+// PlanRecompute collects the behind records of steps (dependencies first) into one plan per symbol
+func PlanRecompute(ctx context.Context, steps []Step, symbols []string) ([]RecomputePlan, error) {
+	var res []RecomputePlan
+
+	plans := make(map[string]*RecomputePlan)
+	for _, step := range steps {
+		if step.Version == 0 || len(step.Outputs) == 0 {
+			continue
+		}
+		behind, err := FindBehind(ctx, step, symbols)
+		if err != nil {
+			return res, err
+		}
+		for _, b := range behind {
+			p, ok := plans[b.Symbol]
+			if !ok {
+				p = &RecomputePlan{Symbol: b.Symbol, Range: DateRange{From: b.From, To: b.To}}
+				plans[b.Symbol] = p
+			}
+			p.Steps = append(p.Steps, step)
+			p.Records += b.Records
+			if b.From.Before(p.Range.From) {
+				p.Range.From = b.From
+			}
+			if b.To.After(p.Range.To) {
+				p.Range.To = b.To
+			}
+		}
+	}
+	for _, p := range plans {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Symbol < res[j].Symbol
+	})
+	return res, nil
+}
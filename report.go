@@ -0,0 +1,104 @@
+package main
+
+/*
+	Run report: every symbol comes back from the workers as a SymbolResult with the
+	outcome of each step. main prints a summary table at the end and can write it all as json.
+*/
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// step and symbol statuses
+const (
+	STATUSOK      = "ok"
+	STATUSFAILED  = "failed"
+	STATUSSKIPPED = "skipped"
+	// some steps ran before the run was stopped
+	STATUSINTERRUPTED = "interrupted"
+)
+
+type StepResult struct {
+	Step     string        `json:"step"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Records  int64         `json:"records"`
+	Duration time.Duration `json:"duration"`
+}
+
+type SymbolResult struct {
+	Symbol   string        `json:"symbol"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Records  int64         `json:"records"`
+	Duration time.Duration `json:"duration"`
+	Attempts int           `json:"attempts,omitempty"`
+	// Retries counts the database calls that were repeated after a transient error
+	Retries int64 `json:"retries,omitempty"`
+	// Interrupted is set when the run stopped before all steps of the symbol ran
+	Interrupted bool         `json:"interrupted,omitempty"`
+	Steps       []StepResult `json:"steps"`
+}
+
+// Failed tells if any step failed
+func (r SymbolResult) Failed() bool {
+	return r.Status == STATUSFAILED
+}
+
+type RunReport struct {
+	RunID    string         `json:"runid"`
+	Env      string         `json:"env"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Failed   int            `json:"failed"`
+	Retries  int64          `json:"retries"`
+	Results  []SymbolResult `json:"results"`
+}
+
+func NewRunReport(run RunRecord, results []SymbolResult) RunReport {
+	report := RunReport{RunID: run.RunID, Env: run.Env, Started: run.Started, Finished: time.Now(), Retries: RetryCount.Load(),
+		Results: results}
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Symbol < report.Results[j].Symbol
+	})
+	for _, r := range results {
+		if r.Failed() {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// PrintSummary prints one line per symbol with the first error, if any
+func (report RunReport) PrintSummary() {
+	var ok, skipped, interrupted int
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SYMBOL\tSTATUS\tRECORDS\tRETRIES\tTIME\tERROR")
+	for _, r := range report.Results {
+		switch r.Status {
+		case STATUSOK:
+			ok++
+		case STATUSSKIPPED:
+			skipped++
+		case STATUSINTERRUPTED:
+			interrupted++
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", r.Symbol, r.Status, r.Records, r.Retries, r.Duration.Round(time.Millisecond), r.Error)
+	}
+	w.Flush()
+	fmt.Printf("%v symbols: %v ok, %v skipped, %v interrupted, %v failed, %v database retries in %v\n", len(report.Results), ok,
+		skipped, interrupted, report.Failed, report.Retries, report.Finished.Sub(report.Started).Round(time.Second))
+}
+
+func (report RunReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,117 @@
+package main
+
+/*
+	Retries for transient database failures (network blips, primary stepdowns, cursor timeouts).
+	WithRetry runs a read or an idempotent write again with exponential backoff and full jitter:
+	attempt n sleeps a random time up to min(RETRYMAXDELAY, RETRYBASEDELAY * 2^n).
+	Anything that isn't classified as transient is returned right away.
+	Retries are counted per symbol through the step context and for the whole run in RetryCount.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const RETRYATTEMPTS = 5
+const RETRYBASEDELAY = 200 * time.Millisecond
+const RETRYMAXDELAY = 10 * time.Second
+
+// RetryCount is the number of retries in this process
+var RetryCount atomic.Int64
+
+// server error codes that go away on their own: stepdowns, shutdowns, network and cursor timeouts
+var retryableCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	43:    true, // CursorNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+type retryCounterKey struct{}
+
+// WithRetryCounter returns a context whose WithRetry calls are counted in the returned counter
+func WithRetryCounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	counter := &atomic.Int64{}
+	return context.WithValue(ctx, retryCounterKey{}, counter), counter
+}
+
+// IsRetryable tells if err is a transient database error
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.HasErrorLabel("RetryableWriteError") || cmdErr.HasErrorLabel("TransientTransactionError") ||
+			retryableCodes[int(cmdErr.Code)]
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		if writeErr.HasErrorLabel("RetryableWriteError") {
+			return true
+		}
+		return writeErr.WriteConcernError != nil && retryableCodes[writeErr.WriteConcernError.Code]
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		if bulkErr.HasErrorLabel("RetryableWriteError") {
+			return true
+		}
+		return bulkErr.WriteConcernError != nil && retryableCodes[bulkErr.WriteConcernError.Code]
+	}
+	return false
+}
+
+// WithRetry runs fn until it succeeds, fails for good or RETRYATTEMPTS are used up. what names
+// the operation in the log
+func WithRetry(ctx context.Context, what string, fn func() error) error {
+	var err error
+
+	for attempt := 0; attempt < RETRYATTEMPTS; attempt++ {
+		if attempt > 0 {
+			delay := RETRYBASEDELAY << (attempt - 1)
+			if delay > RETRYMAXDELAY {
+				delay = RETRYMAXDELAY
+			}
+			delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+			fmt.Printf("Retrying %v in %v (%v of %v): %v\n", what, delay.Round(time.Millisecond), attempt, RETRYATTEMPTS-1, err)
+			RetryCount.Add(1)
+			if counter, ok := ctx.Value(retryCounterKey{}).(*atomic.Int64); ok {
+				counter.Add(1)
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+		err = fn()
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+	Run records: every stock history run gets an id and a document in XHistRuns
+	describing what it was asked to do and how it ended. The ledger (XHistRunLedger)
+	keeps one document per run, symbol and step so -resume can pick up where a run stopped.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylib2"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const RUNCOLLECTION = "XHistRuns"
+const LEDGERCOLLECTION = "XHistRunLedger"
+
+// run statuses
+const (
+	RUNRUNNING    = "running"
+	RUNCOMPLETE   = "complete"
+	RUNINCOMPLETE = "incomplete"
+)
+
+// run kinds. -resume only continues regular runs, a recompute has its own plan per symbol
+const (
+	RUNREGULAR   = "regular"
+	RUNRECOMPUTE = "recompute"
+)
+
+// RunRecord describes one xhist2 run. Since and Lookback are the resolved date selection
+// so a resumed run works on the same dates even after other symbols moved ahead
+type RunRecord struct {
+	RunID    string    `bson:"runid"`
+	Env      string    `bson:"env"`
+	Kind     string    `bson:"kind"`
+	Host     string    `bson:"host"`
+	Args     []string  `bson:"args"`
+	Symbols  []string  `bson:"symbols"`
+	Since    time.Time `bson:"since"`
+	Lookback int       `bson:"lookback"`
+	Status   string    `bson:"status"`
+	Resumes  int       `bson:"resumes"`
+	Started  time.Time `bson:"started"`
+	Finished time.Time `bson:"finished"`
+}
+
+func NewRunRecord(env string, kind string, symbols []string) RunRecord {
+	host, _ := os.Hostname()
+	now := time.Now()
+	return RunRecord{
+		RunID:   fmt.Sprintf("%v-%v-%v", now.Format("20060102T150405"), host, os.Getpid()),
+		Env:     env,
+		Kind:    kind,
+		Host:    host,
+		Args:    os.Args[1:],
+		Symbols: symbols,
+		Status:  RUNRUNNING,
+		Started: now,
+	}
+}
+
+func SaveRunRecord(run RunRecord) error {
+	coll := mylib2.GetCollection(RUNCOLLECTION)
+	_, err := coll.InsertOne(context.TODO(), run)
+	return err
+}
+
+// LastIncompleteRun finds the most recent regular run in env that did not complete. Runs recorded
+// before kinds existed count as regular
+func LastIncompleteRun(env string) (RunRecord, error) {
+	var res RunRecord
+
+	coll := mylib2.GetCollection(RUNCOLLECTION)
+	filter := bson.D{{Key: "env", Value: env}, {Key: "status", Value: bson.M{"$ne": RUNCOMPLETE}},
+		{Key: "kind", Value: bson.M{"$in": bson.A{RUNREGULAR, nil}}}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "started", Value: -1}})
+	err := coll.FindOne(context.TODO(), filter, opts).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, fmt.Errorf("no incomplete run in %v", env)
+	}
+	return res, err
+}
+
+// MarkRunResumed flags the run as running again
+func MarkRunResumed(runID string) error {
+	coll := mylib2.GetCollection(RUNCOLLECTION)
+	_, err := coll.UpdateOne(context.TODO(), bson.D{{Key: "runid", Value: runID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: RUNRUNNING}}}, {Key: "$inc", Value: bson.D{{Key: "resumes", Value: 1}}}})
+	return err
+}
+
+// FinishRun stores how the run ended
+func FinishRun(runID string, status string) error {
+	coll := mylib2.GetCollection(RUNCOLLECTION)
+	_, err := coll.UpdateOne(context.TODO(), bson.D{{Key: "runid", Value: runID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}, {Key: "finished", Value: time.Now()}}}})
+	return err
+}
+
+// LedgerEntry is the outcome of one step of one symbol in a run
+type LedgerEntry struct {
+	RunID    string    `bson:"runid"`
+	Symbol   string    `bson:"symbol"`
+	Step     string    `bson:"step"`
+	Status   string    `bson:"status"`
+	Error    string    `bson:"error"`
+	Records  int64     `bson:"records"`
+	Finished time.Time `bson:"finished"`
+}
+
+// RecordStep writes the outcome of a step to the ledger, replacing an earlier attempt
+func RecordStep(ctx context.Context, runID string, symbol string, sres StepResult) error {
+	coll := mylib2.GetCollection(LEDGERCOLLECTION)
+	filter := bson.D{{Key: "runid", Value: runID}, {Key: "symbol", Value: symbol}, {Key: "step", Value: sres.Step}}
+	entry := LedgerEntry{RunID: runID, Symbol: symbol, Step: sres.Step, Status: sres.Status, Error: sres.Error,
+		Records: sres.Records, Finished: time.Now()}
+	return WithRetry(ctx, "run ledger", func() error {
+		_, err := coll.ReplaceOne(ctx, filter, entry, options.Replace().SetUpsert(true))
+		return err
+	})
+}
+
+// CompletedSteps returns the steps that finished ok in a run, by symbol
+func CompletedSteps(ctx context.Context, runID string) (map[string]map[string]bool, error) {
+	var entries []LedgerEntry
+
+	res := make(map[string]map[string]bool)
+	coll := mylib2.GetCollection(LEDGERCOLLECTION)
+	cursor, err := coll.Find(ctx, bson.D{{Key: "runid", Value: runID}, {Key: "status", Value: STATUSOK}})
+	if err != nil {
+		return res, err
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return res, err
+	}
+	for _, e := range entries {
+		if res[e.Symbol] == nil {
+			res[e.Symbol] = make(map[string]bool)
+		}
+		res[e.Symbol][e.Step] = true
+	}
+	return res, nil
+}
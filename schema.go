@@ -0,0 +1,199 @@
+package main
+
+/*
+	Index and schema bootstrap. RequiredIndexes is the expected index layout of StockHistory and of the
+	collections xhist2 owns, StockHistorySchema the optional $jsonSchema validator for StockHistory.
+	init-db compares both with the database: missing indexes are created, indexes on the same keys with
+	different options and indexes we don't expect are only reported, nothing is dropped.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylib2"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// validator modes of init-db
+const (
+	VALIDATOROFF   = "off"
+	VALIDATORWARN  = "warn"
+	VALIDATORERROR = "error"
+)
+
+type IndexDef struct {
+	Collection string
+	Name       string
+	Keys       bson.D
+	Unique     bool
+}
+
+var stockHistoryKeyIndex = IndexDef{Collection: "StockHistory", Name: STOCKHISTORYKEYINDEX,
+	Keys: bson.D{{Key: "underlying", Value: 1}, {Key: "datadate", Value: 1}}, Unique: true}
+
+var RequiredIndexes = []IndexDef{
+	stockHistoryKeyIndex,
+	// AddExpectedMovePercentiles reads expectedmove > 0
+	{Collection: "StockHistory", Name: "underlying_1_expectedmove_1", Keys: bson.D{{Key: "underlying", Value: 1}, {Key: "expectedmove", Value: 1}}},
+	// AddRatings reads the records without ratings
+	{Collection: "StockHistory", Name: "underlying_1_ratings.symbol_1", Keys: bson.D{{Key: "underlying", Value: 1}, {Key: "ratings.symbol", Value: 1}}},
+	{Collection: RUNCOLLECTION, Name: "runid_1", Keys: bson.D{{Key: "runid", Value: 1}}, Unique: true},
+	{Collection: RUNCOLLECTION, Name: "env_1_status_1_started_-1", Keys: bson.D{{Key: "env", Value: 1}, {Key: "status", Value: 1}, {Key: "started", Value: -1}}},
+	{Collection: LEDGERCOLLECTION, Name: "runid_1_symbol_1_step_1", Keys: bson.D{{Key: "runid", Value: 1}, {Key: "symbol", Value: 1}, {Key: "step", Value: 1}}, Unique: true},
+	{Collection: LOCKCOLLECTION, Name: "runid_1", Keys: bson.D{{Key: "runid", Value: 1}}},
+	{Collection: QUEUECOLLECTION, Name: "queue_1_symbol_1", Keys: bson.D{{Key: "queue", Value: 1}, {Key: "symbol", Value: 1}}, Unique: true},
+	{Collection: QUEUECOLLECTION, Name: "queue_1_status_1_visibleat_1", Keys: bson.D{{Key: "queue", Value: 1}, {Key: "status", Value: 1}, {Key: "visibleat", Value: 1}}},
+	{Collection: CHANGELOGCOLLECTION, Name: "underlying_1_datadate_1_field_1_changed_1", Keys: bson.D{{Key: "underlying", Value: 1}, {Key: "datadate", Value: 1}, {Key: "field", Value: 1}, {Key: "changed", Value: 1}}},
+	{Collection: IDENTITYCOLLECTION, Name: "symbol_1", Keys: bson.D{{Key: "symbol", Value: 1}}, Unique: true},
+	{Collection: UNIVERSECOLLECTION, Name: "universe_1_date_1", Keys: bson.D{{Key: "universe", Value: 1}, {Key: "date", Value: 1}}, Unique: true},
+	{Collection: WATCHLISTCOLLECTION, Name: "name_1", Keys: bson.D{{Key: "name", Value: 1}}, Unique: true},
+}
+
+var numberType = bson.D{{Key: "bsonType", Value: bson.A{"double", "int", "long", "decimal"}}}
+
+// StockHistorySchema checks the key fields and the types of the computed values. Fields it
+// doesn't list are allowed so new enrichments don't need a schema change first
+var StockHistorySchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"underlying", "datadate"}},
+	{Key: "properties", Value: bson.D{
+		{Key: "underlying", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "datadate", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "schemaversion", Value: bson.D{{Key: "bsonType", Value: bson.A{"int", "long"}}}},
+		{Key: "expectedmove", Value: numberType},
+		{Key: "expectedmovepercentile", Value: numberType},
+		{Key: "ivpercentile30", Value: numberType},
+		{Key: "ivpercentile365", Value: numberType},
+		{Key: "histvol", Value: numberType},
+		{Key: "upricechange1", Value: numberType},
+		{Key: "ratings", Value: bson.D{{Key: "bsonType", Value: "object"}}},
+	}},
+}
+
+// CheckIndexes compares RequiredIndexes with the database and returns one line per difference.
+// With create set the missing indexes are built
+func CheckIndexes(ctx context.Context, create bool) ([]string, error) {
+	var drift []string
+
+	byCollection := make(map[string][]IndexDef)
+	var order []string
+	for _, def := range RequiredIndexes {
+		if _, ok := byCollection[def.Collection]; !ok {
+			order = append(order, def.Collection)
+		}
+		byCollection[def.Collection] = append(byCollection[def.Collection], def)
+	}
+	for _, name := range order {
+		coll := mylib2.GetCollection(name)
+		existing, err := ListIndexes(ctx, coll)
+		if err != nil {
+			return drift, err
+		}
+		expected := make(map[string]bool)
+		for _, def := range byCollection[name] {
+			found := false
+			for _, idx := range existing {
+				if !SameIndexKeys(idx.Key, def.Keys) {
+					continue
+				}
+				found = true
+				expected[idx.Name] = true
+				if idx.Unique != def.Unique {
+					drift = append(drift, fmt.Sprintf("%v: index %v on %v has unique=%v, expected %v", name, idx.Name, indexKeyString(def.Keys), idx.Unique, def.Unique))
+				}
+			}
+			if found {
+				continue
+			}
+			if !create {
+				drift = append(drift, fmt.Sprintf("%v: missing index %v on %v", name, def.Name, indexKeyString(def.Keys)))
+				continue
+			}
+			model := mongo.IndexModel{Keys: def.Keys, Options: options.Index().SetName(def.Name).SetUnique(def.Unique)}
+			err := WithRetry(ctx, "create index "+def.Name, func() error {
+				_, err := coll.Indexes().CreateOne(ctx, model)
+				return err
+			})
+			if err != nil {
+				drift = append(drift, fmt.Sprintf("%v: can't create index %v: %v", name, def.Name, err))
+				continue
+			}
+			fmt.Printf("%v: created index %v\n", name, def.Name)
+		}
+		for _, idx := range existing {
+			if idx.Name != "_id_" && !expected[idx.Name] {
+				drift = append(drift, fmt.Sprintf("%v: unexpected index %v on %v", name, idx.Name, indexKeyString(idx.Key)))
+			}
+		}
+	}
+	return drift, nil
+}
+
+// CheckValidator compares the StockHistory validator with StockHistorySchema and the mode (warn or error).
+// With apply set a differing validator is replaced
+func CheckValidator(ctx context.Context, mode string, apply bool) ([]string, error) {
+	var drift []string
+
+	coll := mylib2.GetCollection("StockHistory")
+	db := coll.Database()
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: coll.Name()}})
+	if err != nil {
+		return drift, err
+	}
+	var current bson.Raw
+	var action string
+	if len(specs) > 0 && specs[0].Options != nil {
+		if v, err := specs[0].Options.LookupErr("validator"); err == nil {
+			current, _ = v.DocumentOK()
+		}
+		if v, err := specs[0].Options.LookupErr("validationAction"); err == nil {
+			action, _ = v.StringValueOK()
+		}
+	}
+
+	validator := bson.D{{Key: "$jsonSchema", Value: StockHistorySchema}}
+	want, err := bson.Marshal(validator)
+	if err != nil {
+		return drift, err
+	}
+	switch {
+	case current == nil:
+		drift = append(drift, "StockHistory: no validator")
+	case current.String() != bson.Raw(want).String():
+		drift = append(drift, "StockHistory: validator differs from the expected schema")
+	case action != "" && action != mode:
+		drift = append(drift, fmt.Sprintf("StockHistory: validation action is %v, expected %v", action, mode))
+	}
+	if len(drift) == 0 || !apply {
+		return drift, nil
+	}
+
+	// moderate leaves existing documents that already break the schema alone until they are updated
+	cmd := bson.D{{Key: "collMod", Value: coll.Name()}, {Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"}, {Key: "validationAction", Value: mode}}
+	err = db.RunCommand(ctx, cmd).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceNotFound" {
+		err = db.CreateCollection(ctx, coll.Name(), options.CreateCollection().SetValidator(validator).
+			SetValidationLevel("moderate").SetValidationAction(mode))
+	}
+	if err != nil {
+		return drift, err
+	}
+	fmt.Printf("StockHistory: validator set to %v\n", mode)
+	return nil, nil
+}
+
+func indexKeyString(keys bson.D) string {
+	s := "{"
+	for i, k := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%v: %v", k.Key, k.Value)
+	}
+	return s + "}"
+}
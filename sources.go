@@ -0,0 +1,62 @@
+package main
+
+/*
+	Feed sources: fundamentals, dividends and corporate actions each come from a feed collection
+	("mongo") or a json file with the same records. The helpers here are the part they share.
+*/
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mylib2"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindSymbolSorted reads the documents of symbol from a feed collection, oldest dateKey first
+func FindSymbolSorted[T any](ctx context.Context, collection string, symbol string, dateKey string) ([]T, error) {
+	var res []T
+
+	coll := mylib2.GetCollection(collection)
+	opts := options.Find().SetSort(bson.D{{Key: dateKey, Value: 1}})
+	err := WithRetry(ctx, "read "+collection, func() error {
+		cursor, err := coll.Find(ctx, bson.D{{Key: "symbol", Value: symbol}}, opts)
+		if err != nil {
+			return err
+		}
+		res = nil
+		return cursor.All(ctx, &res)
+	})
+	return res, err
+}
+
+// datedFileRec is a record of a source file, keyed by symbol and a YYYY-MM-DD date
+type datedFileRec interface {
+	symbolDate() (symbol string, date string)
+}
+
+// ReadDatedFile reads a json array of R from path and returns the records built from them, by symbol
+func ReadDatedFile[R datedFileRec, T any](path string, build func(raw R, date time.Time) T) (map[string][]T, error) {
+	var raw []R
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	recs := make(map[string][]T)
+	for _, r := range raw {
+		symbol, date := r.symbolDate()
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad date %v for %v", path, date, symbol)
+		}
+		recs[symbol] = append(recs[symbol], build(r, d))
+	}
+	return recs, nil
+}
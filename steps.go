@@ -0,0 +1,178 @@
+package main
+
+/*
+	Pipeline steps:
+	Every stage of ProcessSymbol is a registered Step with the steps it depends on.
+	-steps picks a subset (e.g. -steps=em,empct). Selected steps run dependencies first.
+	Dependencies that were not selected are assumed to be in the collection already,
+	a dependency that fails in this run skips everything that needs it.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNothingToDo is returned by a step that found no work. Steps that depend on it are skipped
+// but the symbol does not count as failed
+var ErrNothingToDo = errors.New("nothing to do")
+
+// Step is one stage of the per symbol pipeline. Run returns the number of records written.
+// Version is stamped as algoversions.<name> on the records the step writes, Outputs are fields
+// that tell the step has written a record
+type Step struct {
+	Name      string
+	DependsOn []string
+	Version   int
+	Outputs   []string
+	Run       func(ctx context.Context, symbol string, opts RunOptions) (int64, error)
+	// Enricher is set for steps built with EnricherStep
+	Enricher Enricher
+}
+
+// algorithm versions of the built in steps. bump one when its calculation changes, then run recompute
+const (
+	BASEVERSION    = 1
+	RATINGSVERSION = 1
+	IVPCTVERSION   = 1
+	EMVERSION      = 1
+	EMPCTVERSION   = 1
+)
+
+// StepRegistry lists the steps in their default order
+var StepRegistry = []Step{
+	{Name: "base", Version: BASEVERSION, Outputs: []string{"datadate"}, Run: BuildBaseRecords},
+	{Name: "ratings", DependsOn: []string{"base"}, Version: RATINGSVERSION, Outputs: []string{"ratings"}, Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+		n, err := AddRatings(ctx, symbol, opts.Range, opts.Force)
+		if err != nil {
+			return n, err
+		}
+		// without force only the records that had no rating were looked at
+		var unrated []bson.E
+		if !opts.Force {
+			unrated = append(unrated, bson.E{Key: "ratings.symbol", Value: bson.M{"$in": bson.A{"", nil}}})
+		}
+		return n, StampEvaluated(ctx, "ratings", RATINGSVERSION, symbol, opts.Range, unrated...)
+	}},
+	{Name: "ivpct", DependsOn: []string{"base"}, Version: IVPCTVERSION, Outputs: []string{"ivpercentile30", "histvol"}, Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+		return stampAfter(ctx, "ivpct", IVPCTVERSION, symbol, opts.Range)(AddIVpercentiles(ctx, symbol, opts.CorporateActions, opts.Range))
+	}},
+	{Name: "em", DependsOn: []string{"base"}, Version: EMVERSION, Outputs: []string{"expectedmove"}, Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+		return stampAfter(ctx, "em", EMVERSION, symbol, opts.Range)(AddExpectedMoves(ctx, symbol, opts.Range))
+	}},
+	{Name: "empct", DependsOn: []string{"em"}, Version: EMPCTVERSION, Outputs: []string{"expectedmovepercentile"}, Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+		// days without a move were looked at too, they just have no percentile
+		return stampAfter(ctx, "empct", EMPCTVERSION, symbol, opts.Range)(AddExpectedMovePercentiles(ctx, symbol, opts.Range))
+	}},
+	EnricherStep(SplitAdjustEnricher{}, "base"),
+	EnricherStep(EarningsCycleEnricher{}, "base"),
+	EnricherStep(EarningsSurpriseEnricher{}, "base"),
+	EnricherStep(FundamentalsEnricher{}, "base"),
+	EnricherStep(DividendEnricher{}, "base"),
+}
+
+func findStep(name string) (Step, bool) {
+	for _, s := range StepRegistry {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Step{}, false
+}
+
+func StepNames() []string {
+	var res []string
+
+	for _, s := range StepRegistry {
+		res = append(res, s.Name)
+	}
+	return res
+}
+
+func StepListString(steps []Step) string {
+	var names []string
+
+	for _, s := range steps {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// ResolveSteps turns the -steps flag into the steps to run, dependencies first. "all" or "" is every step
+func ResolveSteps(spec string) ([]Step, error) {
+	var res []Step
+
+	selected := make(map[string]bool)
+	if spec == "" || spec == "all" {
+		for _, s := range StepRegistry {
+			selected[s.Name] = true
+		}
+	} else {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := findStep(name); !ok {
+				return res, fmt.Errorf("unknown step %v. steps are: %v", name, strings.Join(StepNames(), ","))
+			}
+			selected[name] = true
+		}
+	}
+
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("step dependency cycle at %v", name)
+		}
+		visiting[name] = true
+		step, ok := findStep(name)
+		if !ok {
+			return fmt.Errorf("unknown step dependency %v", name)
+		}
+		for _, dep := range step.DependsOn {
+			if selected[dep] {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		res = append(res, step)
+		return nil
+	}
+	for _, s := range StepRegistry {
+		if selected[s.Name] {
+			if err := visit(s.Name); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// BuildBaseRecords runs VolTrend for the new (or with -force, the selected) dates and upserts the records
+func BuildBaseRecords(ctx context.Context, underlying string, opts RunOptions) (int64, error) {
+	History, err := VolTrend(ctx, underlying, opts)
+	if err != nil {
+		return 0, err
+	}
+	if len(History) == 0 {
+		fmt.Printf("No option data for %v. Skipping symbol\n", underlying)
+		return 0, fmt.Errorf("no new option dates: %w", ErrNothingToDo)
+	}
+	// enrichment fields already on the records are kept, the steps below recompute them
+	_, err = UpsertStockHistoryRecs(ctx, History)
+	if err != nil {
+		fmt.Println("Trouble inserting stock history data")
+		fmt.Println(err)
+		return 0, err
+	}
+	return int64(len(History)), nil
+}
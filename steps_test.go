@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveSteps(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"empct,em", "em,empct", false},
+		{" ivpct , base", "base,ivpct", false},
+		// dependencies that aren't selected are left out, the run uses the records already there
+		{"empct", "empct", false},
+		{"base,nosuchstep", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveSteps(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v", tt.spec, err)
+			continue
+		}
+		if !tt.wantErr && StepListString(got) != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.spec, StepListString(got), tt.want)
+		}
+	}
+}
+
+func TestResolveAllSteps(t *testing.T) {
+	for _, spec := range []string{"", "all"} {
+		got, err := ResolveSteps(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(StepRegistry) {
+			t.Errorf("%q: got %v, want every step", spec, StepListString(got))
+		}
+		seen := make(map[string]bool)
+		for _, s := range got {
+			for _, dep := range s.DependsOn {
+				if !seen[dep] {
+					t.Errorf("%q: %v runs before its dependency %v", spec, s.Name, dep)
+				}
+			}
+			seen[s.Name] = true
+		}
+	}
+}
+
+func TestResolveStepsCycle(t *testing.T) {
+	saved := StepRegistry
+	defer func() { StepRegistry = saved }()
+	StepRegistry = []Step{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}}
+
+	_, err := ResolveSteps("all")
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("got %v, want a cycle error", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+/*
+	Symbol selection for -symbol and -exclude. A spec is a comma separated list of:
+	  0 or ALL          all weekly stocks
+	  AAPL              a single ticker
+	  SM*, ?BM          glob matched against the weekly stocks
+	  @file             tickers from a file (whitespace or comma separated, # starts a comment)
+	  -                 tickers from stdin, same format as @file
+	  watchlist:semis   a named watchlist from the Watchlists collection
+*/
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mylib2"
+	"os"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const WATCHLISTCOLLECTION = "Watchlists"
+
+// Watchlist is a named list of symbols kept in mongo
+type Watchlist struct {
+	Name    string   `bson:"name"`
+	Symbols []string `bson:"symbols"`
+}
+
+// SelectSymbols resolves the include and exclude specs into the list of symbols to process,
+// in the order they were first named. isFullUniverse tells if include named all weekly stocks
+func SelectSymbols(include string, exclude string, weekly []string) (res []string, isFullUniverse bool, err error) {
+	included, isFullUniverse, err := ExpandSymbolSpec(include, weekly)
+	if err != nil {
+		return res, false, err
+	}
+	excluded, _, err := ExpandSymbolSpec(exclude, weekly)
+	if err != nil {
+		return res, false, err
+	}
+	skip := make(map[string]bool)
+	for _, s := range excluded {
+		skip[s] = true
+	}
+	for _, s := range included {
+		if !skip[s] {
+			skip[s] = true
+			res = append(res, s)
+		}
+	}
+	return res, isFullUniverse, nil
+}
+
+// IsFullUniverseSpec tells if spec names all weekly stocks, without expanding it
+func IsFullUniverseSpec(spec string) bool {
+	for _, token := range strings.Split(spec, ",") {
+		if isAllToken(strings.TrimSpace(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllToken(token string) bool {
+	return token == "0" || strings.EqualFold(token, "ALL")
+}
+
+// ExpandSymbolSpec turns one spec into tickers. An empty spec gives no tickers.
+// isFullUniverse tells if the spec named all weekly stocks
+func ExpandSymbolSpec(spec string, weekly []string) (res []string, isFullUniverse bool, err error) {
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		switch {
+		case token == "":
+			continue
+		case isAllToken(token):
+			if len(weekly) == 0 {
+				return res, false, errors.New("weekly stock list is empty")
+			}
+			isFullUniverse = true
+			res = append(res, weekly...)
+		case token == "-":
+			symbols, err := ReadSymbols(os.Stdin)
+			if err != nil {
+				return res, false, fmt.Errorf("stdin: %w", err)
+			}
+			res = append(res, symbols...)
+		case strings.HasPrefix(token, "@"):
+			f, err := os.Open(token[1:])
+			if err != nil {
+				return res, false, err
+			}
+			symbols, err := ReadSymbols(f)
+			f.Close()
+			if err != nil {
+				return res, false, fmt.Errorf("%v: %w", token[1:], err)
+			}
+			res = append(res, symbols...)
+		case strings.HasPrefix(token, "watchlist:"):
+			wl, err := GetWatchlist(strings.TrimPrefix(token, "watchlist:"))
+			if err != nil {
+				return res, false, err
+			}
+			res = append(res, wl.Symbols...)
+		case strings.ContainsAny(token, "*?["):
+			pattern := strings.ToUpper(token)
+			matched := false
+			for _, s := range weekly {
+				ok, err := path.Match(pattern, s)
+				if err != nil {
+					return res, false, fmt.Errorf("bad pattern %v: %w", token, err)
+				}
+				if ok {
+					res = append(res, s)
+					matched = true
+				}
+			}
+			if !matched {
+				fmt.Printf("pattern %v matched no weekly stocks\n", token)
+			}
+		default:
+			res = append(res, strings.ToUpper(token))
+		}
+	}
+	return res, isFullUniverse, nil
+}
+
+// ReadSymbols reads whitespace or comma separated tickers. Anything after # on a line is ignored
+func ReadSymbols(r io.Reader) ([]string, error) {
+	var res []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, f := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			res = append(res, strings.ToUpper(f))
+		}
+	}
+	return res, scanner.Err()
+}
+
+func GetWatchlist(name string) (Watchlist, error) {
+	var res Watchlist
+
+	coll := mylib2.GetCollection(WATCHLISTCOLLECTION)
+	err := coll.FindOne(context.TODO(), bson.D{{Key: "name", Value: name}}).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, fmt.Errorf("no watchlist named %v", name)
+	}
+	return res, err
+}
+
+func SaveWatchlist(wl Watchlist) error {
+	coll := mylib2.GetCollection(WATCHLISTCOLLECTION)
+	_, err := coll.UpdateOne(context.TODO(), bson.D{{Key: "name", Value: wl.Name}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "symbols", Value: wl.Symbols}}}}, options.Update().SetUpsert(true))
+	return err
+}
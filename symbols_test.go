@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSymbols(t *testing.T) {
+	in := "aapl, msft\n# a comment\nnvda\tamd # trailing comment\n\n,,tsla"
+	got, err := ReadSymbols(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "AAPL,MSFT,NVDA,AMD,TSLA"; strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %v", strings.Join(got, ","), want)
+	}
+}
+
+func TestSelectSymbols(t *testing.T) {
+	weekly := []string{"AAPL", "AMD", "IBM", "SMCI", "SMH"}
+	file := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(file, []byte("ibm\nxom # energy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		weekly  []string
+		want    string
+		full    bool
+		wantErr bool
+	}{
+		{"tickers", "aapl, msft", "", weekly, "AAPL,MSFT", false, false},
+		{"all", "0", "", weekly, "AAPL,AMD,IBM,SMCI,SMH", true, false},
+		{"ALL", "all", "", weekly, "AAPL,AMD,IBM,SMCI,SMH", true, false},
+		{"all but excluded", "ALL", "SM*", weekly, "AAPL,AMD,IBM", true, false},
+		{"glob", "SM*,?MD", "", weekly, "SMCI,SMH,AMD", false, false},
+		{"file", "@" + file, "", weekly, "IBM,XOM", false, false},
+		{"first mention keeps its place", "ibm,aapl,IBM", "", weekly, "IBM,AAPL", false, false},
+		{"all without weekly stocks", "0", "", nil, "", false, true},
+		{"missing file", "@" + file + ".missing", "", weekly, "", false, true},
+		{"bad pattern", "[", "", weekly, "", false, true},
+	}
+	for _, tt := range tests {
+		got, full, err := SelectSymbols(tt.include, tt.exclude, tt.weekly)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: error %v", tt.name, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if strings.Join(got, ",") != tt.want || full != tt.full {
+			t.Errorf("%v: got %v full %v, want %v full %v", tt.name, strings.Join(got, ","), full, tt.want, tt.full)
+		}
+	}
+}
+
+func TestIsFullUniverseSpec(t *testing.T) {
+	for spec, want := range map[string]bool{"0": true, "ALL": true, "aapl, all": true, "aapl": false, "": false, "@all.txt": false} {
+		if got := IsFullUniverseSpec(spec); got != want {
+			t.Errorf("%q: got %v, want %v", spec, got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+/*
+	Point in time universe:
+	Every run stores the weekly stock list under the latest options date, so backtests can ask
+	which symbols were in the universe on a given day instead of using today's list.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mylib2"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const UNIVERSECOLLECTION = "UniverseMembership"
+const WEEKLYUNIVERSE = "weekly"
+
+// UniverseSnapshot is the membership of a universe as of Date
+type UniverseSnapshot struct {
+	Universe string    `bson:"universe"`
+	Date     time.Time `bson:"date"`
+	Symbols  []string  `bson:"symbols"`
+}
+
+// SnapshotWeeklyUniverse records today's weekly stocks under the latest options date and returns them
+func SnapshotWeeklyUniverse() ([]string, error) {
+	symbols, err := mylib2.GetWeeklyStocks()
+	if err != nil {
+		return symbols, err
+	}
+	date, err := mylib2.FindMaxDateOptions()
+	if err != nil {
+		return symbols, err
+	}
+	coll := mylib2.GetCollection(UNIVERSECOLLECTION)
+	filter := bson.D{{Key: "universe", Value: WEEKLYUNIVERSE}, {Key: "date", Value: date}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "symbols", Value: symbols}}}}
+	_, err = coll.UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	if err == nil {
+		fmt.Printf("Universe snapshot %v: %v symbols\n", date.Format("2006-01-02"), len(symbols))
+	}
+	return symbols, err
+}
+
+// UniverseOn returns the members of universe on date, taken from the latest snapshot on or before it
+func UniverseOn(universe string, date time.Time) (UniverseSnapshot, error) {
+	var res UniverseSnapshot
+
+	coll := mylib2.GetCollection(UNIVERSECOLLECTION)
+	filter := bson.D{{Key: "universe", Value: universe}, {Key: "date", Value: bson.M{"$lte": date}}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}})
+	err := coll.FindOne(context.TODO(), filter, opts).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, fmt.Errorf("no %v universe snapshot on or before %v", universe, date.Format("2006-01-02"))
+	}
+	return res, err
+}
+
+// UniverseHistory holds all snapshots of a universe to answer membership questions without round trips
+type UniverseHistory struct {
+	Universe  string
+	dates     []time.Time
+	snapshots []map[string]bool
+}
+
+func LoadUniverseHistory(universe string) (*UniverseHistory, error) {
+	var snaps []UniverseSnapshot
+
+	coll := mylib2.GetCollection(UNIVERSECOLLECTION)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: 1}})
+	cursor, err := coll.Find(context.TODO(), bson.D{{Key: "universe", Value: universe}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.TODO(), &snaps); err != nil {
+		return nil, err
+	}
+	uh := &UniverseHistory{Universe: universe}
+	for _, snap := range snaps {
+		members := make(map[string]bool, len(snap.Symbols))
+		for _, s := range snap.Symbols {
+			members[s] = true
+		}
+		uh.dates = append(uh.dates, snap.Date)
+		uh.snapshots = append(uh.snapshots, members)
+	}
+	return uh, nil
+}
+
+// IsMember tells if symbol was in the universe on date. Dates before the first snapshot
+// can't be judged and count as members
+func (uh *UniverseHistory) IsMember(symbol string, date time.Time) bool {
+	idx := sort.Search(len(uh.dates), func(i int) bool {
+		return uh.dates[i].After(date)
+	})
+	if idx == 0 {
+		return true
+	}
+	return uh.snapshots[idx-1][symbol]
+}
@@ -12,14 +12,20 @@ package main
 
 */
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"mylib2"
+	"os"
+	"os/signal"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -34,7 +40,95 @@ const TDAYSANNUALY int = 252
 const TDAYSMONTHLY int = 22
 const TDAYSQUARTERLY int = 63
 
+// RunOptions carries the run settings from main down to the workers
+type RunOptions struct {
+	// Lookback keeps only the latest Lookback option dates. 0 means no limit
+	Lookback int
+	// Since keeps only option dates after it (AUTO mode). zero means no limit
+	Since time.Time
+	// Range is the explicit -from/-to window. It limits the base records and what the enrichment steps write
+	Range        DateRange
+	Fundamentals FundamentalsSource
+	Dividends    DividendSource
+	// CorporateActions adjusts prices for splits and spin-offs. nil means raw prices
+	CorporateActions CorporateActionSource
+	// Universe limits history to the dates a symbol was in the weekly universe. nil means no limit
+	Universe *UniverseHistory
+	// Force rebuilds base records that already exist and upserts them in place
+	Force bool
+	// Steps are the pipeline steps to run, dependencies first
+	Steps []Step
+	// OnError is the failed symbol policy, Retries the extra attempts for ONERRORRETRY
+	OnError string
+	Retries int
+	// Lease is the symbol lock ProcessSymbol works under. Losing it fails the current step
+	Lease *Lease
+	// Worker tells the worker threads of a process apart in lock and queue job owners
+	Worker string
+	// RunID keys the ledger and owns the locks, Completed holds the steps a resumed run already finished, by symbol
+	Env       string
+	RunID     string
+	Completed map[string]map[string]bool
+}
+
+// DateRange is an inclusive date window. A zero From or To leaves that side open
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+func (r DateRange) Contains(t time.Time) bool {
+	if !r.From.IsZero() && t.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && t.After(r.To) {
+		return false
+	}
+	return true
+}
+
+func (r DateRange) IsSet() bool {
+	return !r.From.IsZero() || !r.To.IsZero()
+}
+
+// String prints the range as "2024-01-02 to 2024-03-01", an open side is "open"
+func (r DateRange) String() string {
+	side := func(t time.Time) string {
+		if t.IsZero() {
+			return "open"
+		}
+		return t.Format("2006-01-02")
+	}
+	return side(r.From) + " to " + side(r.To)
+}
+
+// ParseDateRange reads the -from/-to flags, YYYY-MM-DD, either may be empty
+func ParseDateRange(from string, to string) (DateRange, error) {
+	var res DateRange
+	var err error
+
+	if from != "" {
+		res.From, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return res, fmt.Errorf("invalid -from %v", from)
+		}
+	}
+	if to != "" {
+		res.To, err = time.Parse("2006-01-02", to)
+		if err != nil {
+			return res, fmt.Errorf("invalid -to %v", to)
+		}
+	}
+	if !res.From.IsZero() && !res.To.IsZero() && res.To.Before(res.From) {
+		return res, fmt.Errorf("-to %v is before -from %v", to, from)
+	}
+	return res, nil
+}
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(RunCommand(os.Args[1], os.Args[2:]))
+	}
 	var lookback int
 	var err error
 	var SymbolList []string
@@ -43,138 +137,508 @@ func main() {
 	fmt.Println("WELCOME TO STOCK HISTORY")
 
 	envFlag := flag.String("env", "DEV", "Environment: dev or prod")
-	symbolFlag := flag.String("symbol", "0", "Symbol: default is 0")
+	symbolFlag := flag.String("symbol", "0", "Symbols: 0 for all weekly stocks, tickers, globs, @file, - for stdin or watchlist:name, comma separated")
+	excludeFlag := flag.String("exclude", "", "Symbols to leave out, same format as -symbol")
 	lookBackFlag := flag.String("lookback", "AUTO", "default lookback is AUTO")
+	fromFlag := flag.String("from", "", "first date to process, YYYY-MM-DD. overrides lookback")
+	toFlag := flag.String("to", "", "last date to process, YYYY-MM-DD. overrides lookback")
 	threadsFlag := flag.String("threads", "1", "default is 1")
+	fundamentalsFlag := flag.String("fundamentals", "", "fundamentals source: mongo or a json file. default is off")
+	dividendsFlag := flag.String("dividends", "", "dividend calendar source: mongo or a json file. default is off")
+	corpActionsFlag := flag.String("corpactions", "", "splits and spin-offs source: mongo or a json file. default is off")
+	pitFlag := flag.Bool("pit", false, "only build history for dates the symbol was in the weekly universe")
+	stepsFlag := flag.String("steps", "all", "comma separated pipeline steps: "+strings.Join(StepNames(), ","))
+	onErrorFlag := flag.String("onerror", ONERRORSKIP, "what a failed symbol does to the run: skip, retry or abort")
+	retriesFlag := flag.Int("retries", 2, "extra attempts per failed symbol with -onerror=retry")
+	reportFlag := flag.String("report", "", "write the per symbol results to this json file")
+	forceFlag := flag.Bool("force", false, "recompute existing records in the -from/-to range (or numeric -lookback) and update them in place")
+	queueFlag := flag.String("queue", "", "queue mode: enqueue the selected symbols in this named queue and work it with other xhist2 processes")
+	auditFlag := flag.Bool("audit", false, "log every changed StockHistory field with its old value in "+CHANGELOGCOLLECTION)
+	resumeFlag := flag.Bool("resume", false, "continue the last incomplete run in this environment, skipping finished steps")
 
 	flag.Parse()
 
-	fmt.Printf("Running with: %v %v %v %v\n", *envFlag, *symbolFlag, *lookBackFlag, *threadsFlag)
 	// Initialize the database connection
 	mylib2.InitDB(*envFlag)
+	if err := EnsureStockHistoryIndex(context.TODO()); err != nil {
+		fmt.Printf("WARNING: no unique (underlying, datadate) index on StockHistory, concurrent runs can duplicate records: %v\n", err)
+	}
+
+	var resumed *RunRecord
+	if *resumeFlag {
+		last, err := LastIncompleteRun(*envFlag)
+		if err != nil {
+			log.Fatalf("Can't resume: %v", err)
+		}
+		// a run that still renews its locks is alive, resuming it would run the same symbols twice
+		if lock, held, err := RunLock(last.RunID); err != nil {
+			log.Fatalf("Can't resume: can't read locks: %v", err)
+		} else if held {
+			log.Fatalf("Can't resume run %v: it is still running on %v (pid %v), lock %v expires %v", last.RunID, lock.Host,
+				lock.Pid, lock.Name, lock.Expires.Format(time.DateTime))
+		}
+		// the original run's flags come back, flags given with -resume (e.g. -threads) win
+		flag.CommandLine.Parse(last.Args)
+		flag.CommandLine.Parse(os.Args[1:])
+		resumed = &last
+		fmt.Printf("Resuming run %v started %v\n", last.RunID, last.Started.Format(time.DateTime))
+	}
+	fmt.Printf("Running with: %v %v %v %v\n", *envFlag, *symbolFlag, *lookBackFlag, *threadsFlag)
 
 	lookbackStr := *lookBackFlag
 	threads, err := strconv.Atoi(*threadsFlag)
+	if err != nil || threads < 1 {
+		fmt.Printf("INVALID threads value %v\n", *threadsFlag)
+		os.Exit(2)
+	}
+	if !ValidOnError(*onErrorFlag) {
+		fmt.Printf("INVALID onerror policy %v. use skip, retry or abort\n", *onErrorFlag)
+		os.Exit(2)
+	}
+	// every run records the weekly universe so history can be read point in time
+	weeklyList, err := SnapshotWeeklyUniverse()
 	if err != nil {
-		log.Panic("invalid thread value")
+		fmt.Printf("Can't snapshot weekly universe: %v\n", err)
 	}
-	symbol := *symbolFlag
-
-	if symbol == "0" {
-		SymbolList, err = mylib2.GetWeeklyStocks()
+	var fullUniverse bool
+	if resumed != nil {
+		SymbolList = resumed.Symbols
+		fullUniverse = IsFullUniverseSpec(*symbolFlag)
+	} else {
+		SymbolList, fullUniverse, err = SelectSymbols(*symbolFlag, *excludeFlag, weeklyList)
 		if err != nil {
-			log.Fatal("Can't get weekly stocks")
+			log.Fatalf("Can't select symbols: %v", err)
 		}
+		SymbolList, err = ActiveSymbols(SymbolList)
+		if err != nil {
+			log.Fatalf("Can't select symbols: %v", err)
+		}
+	}
+	if len(SymbolList) == 0 {
+		log.Fatal("No symbols selected")
+	}
+	if fullUniverse && *excludeFlag == "" {
 		lookbackFilter = bson.D{{}}
 	} else {
-		lookbackFilter = bson.D{{Key: "underlying", Value: symbol}}
-		SymbolList = append(SymbolList, symbol)
+		lookbackFilter = bson.D{{Key: "underlying", Value: bson.M{"$in": SymbolList}}}
 	}
+	fmt.Printf("Selected %v symbols: %v\n", len(SymbolList), strings.Join(SymbolList, ","))
 
-	if lookbackStr != "AUTO" {
+	dateRange, err := ParseDateRange(*fromFlag, *toFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *forceFlag && !dateRange.IsSet() && lookbackStr == "AUTO" {
+		log.Fatal("-force needs -from/-to or a numeric -lookback")
+	}
+	var since time.Time
+	if resumed != nil {
+		lookback = resumed.Lookback
+		since = resumed.Since
+	} else if dateRange.IsSet() {
+		fmt.Printf("Using dates %v\n", dateRange)
+	} else if lookbackStr != "AUTO" {
 		lookback, err = strconv.Atoi(lookbackStr)
 		if err != nil {
 			fmt.Printf("INVALID lookback period %v\n", lookbackStr)
 			return
 		}
+		fmt.Printf("Using %v days for lookback\n", lookback)
 	} else {
-		maxDateOptions, err := mylib2.FindMaxDateOptions()
+		// AUTO picks up every option trading date after the latest stock history date
+		err = WithRetry(context.TODO(), "latest stock history date", func() (err error) {
+			since, err = mylib2.FindMaxDateStockHistory(lookbackFilter)
+			return err
+		})
 		if err != nil {
 			log.Fatal("can't find latest date")
 		}
-		maxDateStockHistory, err := mylib2.FindMaxDateStockHistory(lookbackFilter)
-		if err != nil {
-			log.Fatal("can't find latest date")
+		fmt.Printf("Using option dates after %v\n", since.Format("2006-01-02"))
+	}
+
+	var run RunRecord
+	if resumed != nil {
+		run = *resumed
+		if err := MarkRunResumed(run.RunID); err != nil {
+			fmt.Printf("Can't update run: %v\n", err)
+		}
+	} else {
+		run = NewRunRecord(*envFlag, RUNREGULAR, SymbolList)
+		run.Since = since
+		run.Lookback = lookback
+		if err := SaveRunRecord(run); err != nil {
+			fmt.Printf("Can't record run: %v\n", err)
 		}
-		diff := maxDateOptions.Sub(maxDateStockHistory)
-		lookback = int(diff.Hours() / 24)
 	}
-	fmt.Printf("Using %v days for lookback\n", lookback)
+	fmt.Printf("Run id %v\n", run.RunID)
+	if *auditFlag {
+		Audit = &AuditLog{RunID: run.RunID}
+	}
 
-	jobs := make(chan string, 10000)
-	results := make(chan bool, 10000)
+	fundamentals, err := NewFundamentalsSource(*fundamentalsFlag)
+	if err != nil {
+		log.Fatalf("can't open fundamentals source: %v", err)
+	}
+	dividends, err := NewDividendSource(*dividendsFlag)
+	if err != nil {
+		log.Fatalf("can't open dividends source: %v", err)
+	}
+	corpActions, err := NewCorporateActionSource(*corpActionsFlag)
+	if err != nil {
+		log.Fatalf("can't open corporate actions source: %v", err)
+	}
+	opts := RunOptions{Lookback: lookback, Since: since, Range: dateRange, Fundamentals: fundamentals, Dividends: dividends, CorporateActions: corpActions,
+		Force: *forceFlag, OnError: *onErrorFlag, Retries: *retriesFlag, Env: *envFlag, RunID: run.RunID}
+	if resumed != nil {
+		opts.Completed, err = CompletedSteps(context.TODO(), run.RunID)
+		if err != nil {
+			log.Fatalf("Can't read run ledger: %v", err)
+		}
+	}
+	opts.Steps, err = ResolveSteps(*stepsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Running steps: %v\n", StepListString(opts.Steps))
+	if *pitFlag {
+		opts.Universe, err = LoadUniverseHistory(WEEKLYUNIVERSE)
+		if err != nil {
+			log.Fatalf("can't load universe history: %v", err)
+		}
+	}
 
-	for i := 0; i < threads; i++ {
-		go loader(jobs, results, lookback)
+	// a full universe run owns the environment, so a second one (e.g. cron overlapping a slow run) stops here.
+	// queue workers share the environment on purpose and rely on the symbol locks
+	var envLease *Lease
+	if fullUniverse && *queueFlag == "" {
+		envLease, err = AcquireLock(context.TODO(), EnvLockName(*envFlag), run.RunID, "")
+		if err != nil {
+			FinishRun(run.RunID, RUNINCOMPLETE)
+			log.Fatalf("Can't start run: %v", err)
+		}
 	}
 
-	for _, symbol := range SymbolList {
-		jobs <- symbol
+	jobs := make(chan string, 10000)
+	results := make(chan SymbolResult, 10000)
+
+	// the first SIGINT/SIGTERM (or -onerror=abort) stops new work. symbols in flight finish
+	// their current step, a second signal exits right away
+	ctx, cancelRun := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		fmt.Printf("Received %v: finishing current steps, remaining symbols are skipped. Interrupt again to exit now\n", sig)
+		cancelRun(fmt.Errorf("%w by %v", ErrInterrupted, sig))
+	}()
+	if envLease != nil {
+		// another run owns the environment now, stop starting symbols
+		context.AfterFunc(envLease.Context(), func() {
+			if cause := context.Cause(envLease.Context()); errors.Is(cause, ErrLeaseLost) {
+				cancelRun(fmt.Errorf("%w: %v", ErrRunAborted, cause))
+			}
+		})
 	}
 
+	var workers sync.WaitGroup
+	if *queueFlag != "" {
+		queue := NewQueue(mylib2.GetCollection(QUEUECOLLECTION), *queueFlag, QUEUEVISIBILITY)
+		added, err := queue.Enqueue(context.TODO(), SymbolList, NewQueueSelection(opts))
+		if err != nil {
+			log.Fatalf("Can't enqueue symbols: %v", err)
+		}
+		fmt.Printf("Queue %v: %v symbols enqueued\n", queue.Name, added)
+		for i := 0; i < threads; i++ {
+			workers.Add(1)
+			workerOpts := opts
+			workerOpts.Worker = strconv.Itoa(i)
+			go func() {
+				defer workers.Done()
+				queueLoader(ctx, queue, results, workerOpts)
+			}()
+		}
+	} else {
+		for i := 0; i < threads; i++ {
+			workers.Add(1)
+			workerOpts := opts
+			workerOpts.Worker = strconv.Itoa(i)
+			go func() {
+				defer workers.Done()
+				loader(ctx, jobs, results, workerOpts)
+			}()
+		}
+		for _, symbol := range SymbolList {
+			jobs <- symbol
+		}
+	}
 	close(jobs)
-
-	for i := 0; i < len(SymbolList); i++ {
-		res := <-results
-		if !res {
-			fmt.Println("Error processing symbol")
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var symbolResults []SymbolResult
+	for res := range results {
+		if res.Failed() {
+			fmt.Printf("Error processing %v: %v\n", res.Symbol, res.Error)
+			if opts.OnError == ONERRORABORT && ctx.Err() == nil {
+				fmt.Println("Aborting run, symbols not started yet are skipped")
+				cancelRun(fmt.Errorf("%w after %v failed", ErrRunAborted, res.Symbol))
+			}
 		}
+		symbolResults = append(symbolResults, res)
 	}
 
+	report := NewRunReport(run, symbolResults)
+	report.PrintSummary()
+	if *reportFlag != "" {
+		if err := report.WriteJSON(*reportFlag); err != nil {
+			fmt.Printf("Can't write report %v: %v\n", *reportFlag, err)
+		}
+	}
+	runStatus := RUNCOMPLETE
+	if report.Failed > 0 || ctx.Err() != nil {
+		runStatus = RUNINCOMPLETE
+	}
+	if err := FinishRun(run.RunID, runStatus); err != nil {
+		fmt.Printf("Can't update run: %v\n", err)
+	}
+	fmt.Printf("Run %v is %v\n", run.RunID, runStatus)
+	if envLease != nil {
+		if err := envLease.Release(); err != nil {
+			fmt.Printf("Can't release lock %v: %v\n", envLease.Name, err)
+		}
+	}
 	fmt.Println("Done")
-
+	if errors.Is(context.Cause(ctx), ErrInterrupted) {
+		os.Exit(130)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
 }
-func ProcessSymbol(underlying string, lookback int) bool {
-	var status bool = true
 
-	History := VolTrend(underlying, lookback)
-
-	if len(History) == 0 {
-		fmt.Printf("No option data for %v. Skipping symbol\n", underlying)
-		return false
+// ProcessSymbol runs the selected steps for one symbol. Once ctx is cancelled no new step
+// starts, but the step already running is allowed to finish its writes
+func ProcessSymbol(ctx context.Context, underlying string, opts RunOptions) (result SymbolResult) {
+	result = SymbolResult{Symbol: underlying, Status: STATUSOK}
+	start := time.Now()
+	// steps finish their writes when the run is stopped, only losing the symbol lock cuts them short
+	stepCtx, cancelSteps := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer cancelSteps(nil)
+	if opts.Lease != nil {
+		stop := context.AfterFunc(opts.Lease.Context(), func() {
+			cancelSteps(context.Cause(opts.Lease.Context()))
+		})
+		defer stop()
 	}
+	stepCtx, retries := WithRetryCounter(stepCtx)
+	defer func() { result.Retries = retries.Load() }()
+
 	/*
-		Now we enrich the basic VolTrend with earinings data,
+		The base step builds the VolTrend records, the others enrich them with earinings data,
 		IV pct data, stock hist vol, stock move data, etc..
 	*/
-	_, err := mylib2.InsertStockHistoryRecsBulk(History)
-	if err != nil {
-		fmt.Println("Trouble inserting stock history data")
-		fmt.Println(err)
-		status = false
+	blockedBy := make(map[string]string)
+	for _, step := range opts.Steps {
+		sres := StepResult{Step: step.Name, Status: STATUSOK}
+		for _, dep := range step.DependsOn {
+			if reason, ok := blockedBy[dep]; ok {
+				sres.Status = STATUSSKIPPED
+				sres.Error = reason
+			}
+		}
+		if ctx.Err() != nil {
+			sres.Status = STATUSSKIPPED
+			sres.Error = context.Cause(ctx).Error()
+			result.Interrupted = true
+		}
+		if sres.Status != STATUSSKIPPED && opts.Completed[underlying][step.Name] {
+			sres.Status = STATUSSKIPPED
+			sres.Error = "finished in an earlier attempt"
+			result.Steps = append(result.Steps, sres)
+			continue
+		}
+		if sres.Status == STATUSSKIPPED {
+			fmt.Printf("Skipping %v for %v: %v\n", step.Name, underlying, sres.Error)
+			blockedBy[step.Name] = sres.Error
+			result.Steps = append(result.Steps, sres)
+			continue
+		}
+		stepStart := time.Now()
+		var records int64
+		var err error
+		if stepCtx.Err() != nil {
+			err = context.Cause(stepCtx)
+		} else {
+			records, err = step.Run(stepCtx, underlying, opts)
+		}
+		if stepCtx.Err() != nil {
+			// whatever the step returned, it ran (partly) without the lock
+			err = context.Cause(stepCtx)
+		}
+		var perr *PipelineError
+		if err != nil && !errors.As(err, &perr) {
+			err = &PipelineError{Symbol: underlying, Step: step.Name, Err: err}
+		} else if err != nil && perr.Step == "" {
+			perr.Step = step.Name
+		}
+		sres.Duration = time.Since(stepStart)
+		sres.Records = records
+		result.Records += records
+		switch {
+		case errors.Is(err, ErrNothingToDo):
+			sres.Status = STATUSSKIPPED
+			sres.Error = err.Error()
+			blockedBy[step.Name] = fmt.Sprintf("%v had nothing to do", step.Name)
+		case err != nil:
+			sres.Status = STATUSFAILED
+			sres.Error = err.Error()
+			blockedBy[step.Name] = fmt.Sprintf("%v failed", step.Name)
+			if result.Status != STATUSFAILED {
+				result.Status = STATUSFAILED
+				result.Error = fmt.Sprintf("%v: %v", step.Name, err)
+			}
+		}
+		if opts.RunID != "" {
+			if err := RecordStep(stepCtx, opts.RunID, underlying, sres); err != nil {
+				fmt.Printf("Can't record %v %v in the run ledger: %v\n", underlying, step.Name, err)
+			}
+		}
+		result.Steps = append(result.Steps, sres)
 	}
-
-	//Next lets add ratings
-	//AddRatings(underlying)
-	AddIVpercentiles(underlying)
-	AddExpectedMoves(underlying)
-	AddExpectedMovePercentiles(underlying)
+	// nothing ran at all, e.g. no new option dates
+	if result.Status == STATUSOK && len(result.Steps) > 0 {
+		allSkipped := true
+		for _, sres := range result.Steps {
+			if sres.Status != STATUSSKIPPED {
+				allSkipped = false
+			}
+		}
+		if allSkipped {
+			result.Status = STATUSSKIPPED
+			result.Error = result.Steps[0].Error
+		} else if result.Interrupted {
+			result.Status = STATUSINTERRUPTED
+			result.Error = context.Cause(ctx).Error()
+		}
+	}
+	result.Duration = time.Since(start)
 	fmt.Printf("Finished %v %v\n", underlying, time.Now())
-	return status
+	return result
 }
-func loader(jobs <-chan string, results chan<- bool, lookback int) {
+func loader(ctx context.Context, jobs <-chan string, results chan<- SymbolResult, opts RunOptions) {
 	for symbol := range jobs {
-		results <- ProcessSymbol(symbol, lookback)
+		if ctx.Err() != nil {
+			results <- SymbolResult{Symbol: symbol, Status: STATUSSKIPPED, Error: context.Cause(ctx).Error()}
+			continue
+		}
+		results <- processWithLock(ctx, symbol, opts)
+	}
+}
+
+// processWithLock runs the steps for one symbol under its symbol lock, retrying per -onerror
+func processWithLock(ctx context.Context, symbol string, opts RunOptions) SymbolResult {
+	// the symbol lock keeps a concurrent run from writing the same history
+	lease, err := AcquireLock(ctx, SymbolLockName(opts.Env, symbol), opts.RunID, opts.Worker)
+	if err != nil {
+		return SymbolResult{Symbol: symbol, Status: STATUSFAILED, Error: err.Error()}
+	}
+	opts.Lease = lease
+	res := RetrySymbol(ctx, symbol, opts)
+	if err := lease.Release(); err != nil {
+		fmt.Printf("Can't release lock %v: %v\n", lease.Name, err)
 	}
+	return res
 }
-func AddRatings(symbol string) {
+
+// RetrySymbol runs the steps for one symbol and with -onerror=retry runs it again while it fails.
+// Steps that succeeded in an earlier attempt count as done, like with -resume, so their
+// dependents run again instead of being blocked by a step that has nothing left to do
+func RetrySymbol(ctx context.Context, symbol string, opts RunOptions) SymbolResult {
+	res := ProcessSymbol(ctx, symbol, opts)
+	if !res.Failed() || opts.OnError != ONERRORRETRY {
+		return res
+	}
+	done := make(map[string]bool)
+	for step := range opts.Completed[symbol] {
+		done[step] = true
+	}
+	for attempt := 1; res.Failed() && attempt <= opts.Retries && ctx.Err() == nil; attempt++ {
+		if opts.Lease != nil && opts.Lease.Context().Err() != nil {
+			break
+		}
+		fmt.Printf("Retrying %v (%v of %v): %v\n", symbol, attempt, opts.Retries, res.Error)
+		for _, sres := range res.Steps {
+			if sres.Status == STATUSOK {
+				done[sres.Step] = true
+			}
+		}
+		retryOpts := opts
+		retryOpts.Completed = map[string]map[string]bool{symbol: done}
+		records, retries := res.Records, res.Retries
+		res = ProcessSymbol(ctx, symbol, retryOpts)
+		res.Attempts = attempt + 1
+		res.Records += records
+		res.Retries += retries
+	}
+	return res
+}
+
+// AddRatings fills ratings on records that don't have one yet, with force on every record in rng.
+// Each day gets the latest rating on or before it so days between rating changes carry the previous rating forward
+func AddRatings(ctx context.Context, symbol string, rng DateRange, force bool) (int64, error) {
 	fmt.Printf("Adding Ratings For: %v\n", symbol)
-	filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "ratings.symbol", Value: ""}}
-	stockHist, hstatus := mylib2.GetStockHistoryData(filter)
-	if !hstatus {
+	filter := bson.D{{Key: "underlying", Value: symbol}}
+	if !force {
+		filter = append(filter, bson.E{Key: "ratings.symbol", Value: bson.M{"$in": bson.A{"", nil}}})
+	}
+	stockHist, err := FindStockHistory(ctx, filter)
+	if err != nil {
+		return 0, &PipelineError{Symbol: symbol, Err: err}
+	}
+	if len(stockHist) == 0 {
 		fmt.Printf("no stock history for %v. skipping symbol\n", symbol)
-		return
+		return 0, nil
 	}
 
 	ratings := mylib2.GetRatingsHistoryForSymbol(symbol)
-	for i, hrec := range stockHist {
-		for _, rrec := range ratings {
-			if hrec.Datadate.Equal(rrec.DateDt) {
-				stockHist[i].Ratings = rrec
-				filter := bson.D{{Key: "underlying", Value: hrec.Underlying}, {Key: "datadate", Value: hrec.Datadate}}
-				update := bson.D{{Key: "$set", Value: bson.D{{Key: "ratings", Value: rrec}}}}
-				matched, updated := mylib2.UpdateOne("StockHistory", filter, update)
-				if matched != 1 || updated != 1 {
-					fmt.Printf("Issue Updating document %v\n", hrec)
-				}
-				break
-			}
-		}
+	if len(ratings) == 0 {
+		fmt.Printf("no ratings for %v. skipping symbol\n", symbol)
+		return 0, nil
 	}
+	sort.Slice(ratings, func(i, j int) bool {
+		return ratings[i].DateDt.Before(ratings[j].DateDt)
+	})
+	sort.Slice(stockHist, func(i, j int) bool {
+		return stockHist[i].Datadate.Before(stockHist[j].Datadate)
+	})
 
+	bulk := NewBulkUpdater("StockHistory")
+	bulk.Step = "ratings"
+	r := -1
+	for _, hrec := range stockHist {
+		for r+1 < len(ratings) && !ratings[r+1].DateDt.After(hrec.Datadate) {
+			r++
+		}
+		if r < 0 || !rng.Contains(hrec.Datadate) {
+			continue
+		}
+		filter := bson.D{{Key: "underlying", Value: hrec.Underlying}, {Key: "datadate", Value: hrec.Datadate}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "ratings", Value: ratings[r]}, AlgoVersion("ratings", RATINGSVERSION)}}}
+		if err := bulk.Add(ctx, filter, update); err != nil {
+			return bulk.Modified, &PipelineError{Symbol: symbol, Err: err}
+		}
+	}
+	if err := bulk.Flush(ctx); err != nil {
+		return bulk.Modified, &PipelineError{Symbol: symbol, Err: err}
+	}
+	fmt.Printf("Updated ratings on %v records for %v\n", bulk.Modified, symbol)
+	return bulk.Modified, nil
 }
 
-func VolTrend(underlying string, lookback int) []mylib2.StockHistory {
+func VolTrend(ctx context.Context, underlying string, opts RunOptions) ([]mylib2.StockHistory, error) {
 	var History []mylib2.StockHistory
 	var status bool
 	fmt.Println("====================================")
@@ -185,19 +649,42 @@ func VolTrend(underlying string, lookback int) []mylib2.StockHistory {
 	sort.Slice(DateList, func(i, j int) bool {
 		return DateList[i].Ddate.Before(DateList[j].Ddate)
 	})
-	if len(DateList) > lookback {
-		DateList = DateList[len(DateList)-lookback:]
+	if opts.Range.IsSet() || !opts.Since.IsZero() {
+		var inRange []mylib2.DateRec
+		for _, d := range DateList {
+			if opts.Range.Contains(d.Ddate) && d.Ddate.After(opts.Since) {
+				inRange = append(inRange, d)
+			}
+		}
+		DateList = inRange
+	} else if opts.Lookback > 0 && len(DateList) > opts.Lookback {
+		DateList = DateList[len(DateList)-opts.Lookback:]
 	}
-
-	//now get dates that are already there
-	trendDates, err := mylib2.GetStockHistoryDates(underlying)
-	if err != nil {
-		fmt.Println("cant get trend dates")
+	if opts.Universe != nil {
+		var members []mylib2.DateRec
+		for _, d := range DateList {
+			if opts.Universe.IsMember(underlying, d.Ddate) {
+				members = append(members, d)
+			}
+		}
+		DateList = members
 	}
-	if len(trendDates) > 0 {
-		DateList, status = CompareDateLists2(DateList, trendDates)
-		if !status {
-			fmt.Println("Issue with the list compare")
+
+	//now get dates that are already there. force rebuilds them as well
+	if !opts.Force {
+		var trendDates []time.Time
+		err := WithRetry(ctx, "stock history dates for "+underlying, func() (err error) {
+			trendDates, err = mylib2.GetStockHistoryDates(underlying)
+			return err
+		})
+		if err != nil {
+			return History, &PipelineError{Symbol: underlying, Err: fmt.Errorf("%w: %v", ErrNoTrendDates, err)}
+		}
+		if len(trendDates) > 0 {
+			DateList, status = CompareDateLists2(DateList, trendDates)
+			if !status {
+				fmt.Println("Issue with the list compare")
+			}
 		}
 	}
 
@@ -211,20 +698,29 @@ func VolTrend(underlying string, lookback int) []mylib2.StockHistory {
 		thisHistRec.Underlying = underlying
 		thisHistRec.Datadate = thisDate.Ddate
 		thisHistRec.WeekDay = thisDate.WeekDay
-		expirations, err := mylib2.GetExpirations(underlying, thisDate.Ddate)
+		var expirations []mylib2.DateRec
+		err := WithRetry(ctx, "expirations for "+underlying, func() (err error) {
+			expirations, err = mylib2.GetExpirations(underlying, thisDate.Ddate)
+			return err
+		})
 		if err != nil {
-			break
+			return History, &PipelineError{Symbol: underlying, Date: thisDate.Ddate, Err: fmt.Errorf("%w: %v", ErrNoExpirations, err)}
 		}
 		for _, thisExpiry := range expirations {
 			// determine what bucket does expiration fall
 			BucketRec := mylib2.DetermineBucket(thisDate, thisExpiry)
-			optList, err := mylib2.GetOptionList(underlying, thisExpiry.Ddate, "put", thisDate.Ddate)
+			var optList []mylib2.Option
+			err := WithRetry(ctx, "option chain for "+underlying, func() (err error) {
+				optList, err = mylib2.GetOptionList(underlying, thisExpiry.Ddate, "put", thisDate.Ddate)
+				return err
+			})
 			if err != nil {
-				break
+				return History, &PipelineError{Symbol: underlying, Date: thisDate.Ddate, Err: fmt.Errorf("%w for %v: %v", ErrNoOptions, thisExpiry.Ddate.Format("2006-01-02"), err)}
 			}
+			// no usable ATM put for this expiry, the bucket is left to the next expiry or FillGaps
 			ATMOpt, err := mylib2.FindATCOption(optList)
 			if err != nil {
-				break
+				continue
 			}
 			if thisHistRec.UnderlyingPrice == 0 {
 				thisHistRec.UnderlyingPrice = ATMOpt.UnderlyingPrice
@@ -387,25 +883,20 @@ func VolTrend(underlying string, lookback int) []mylib2.StockHistory {
 		// Fill the gaps
 		FillGaps(&thisHistRec)
 		// Get earnings info
-		thisHistRec.LastEarningsDate, thisHistRec.NextEarningsDate, thisHistRec.LastEarningsSurprise, thisHistRec.IsEarnings = GetEarnings(thisHistRec.Underlying, thisDate.Ddate)
-		// Get DCF Info
-		//thisHistRec.DCF = fmplib.GetDCF(thisHistRec.Underlying)
-		//thisRatingHistory := fmplib.GetRatingsHistoryForSymbol(thisHistRec.Underlying)
-		//fmt.Println(thisRatingHistory)
-		// Get
-		if !mylib2.IsThereStockHistRec(thisHistRec.Underlying, thisDate.Ddate) {
-			History = append(History, thisHistRec)
-			//fmt.Printf("adding %v %v\n", thisHistRec.Underlying, thisDate.Ddate)
-		} else {
-			fmt.Printf("skipping %v %v\n", thisHistRec.Underlying, thisDate.Ddate)
+		thisHistRec.LastEarningsDate, thisHistRec.NextEarningsDate, thisHistRec.LastEarningsSurprise, thisHistRec.IsEarnings, err = GetEarnings(ctx, thisHistRec.Underlying, thisDate.Ddate)
+		if err != nil {
+			return History, err
 		}
+		// valuation comes from the fundamentals step, ratings from the ratings step.
+		// records are upserted on (underlying, datadate) so an existing one is updated, not duplicated
+		History = append(History, thisHistRec)
 		/*
 			if math.Mod(float64(i), 100) == 0 {
 				fmt.Printf("Processed %v recs. %v\n", i, time.Now())
 			}
 		*/
 	}
-	return History
+	return History, nil
 }
 func FillGaps(hrec *mylib2.StockHistory) {
 	if hrec.Day365 == 0 {
@@ -426,16 +917,20 @@ func FillGaps(hrec *mylib2.StockHistory) {
 		}
 	}
 }
-func GetEarnings(symbol string, histdate time.Time) (time.Time, time.Time, float64, bool) {
+func GetEarnings(ctx context.Context, symbol string, histdate time.Time) (time.Time, time.Time, float64, bool, error) {
 	var lastEarnings time.Time
 	var nextEarnings time.Time
 	var surprise float64
 	var IsEarnings bool = false
 	var assigned bool = false
 
-	eList, err := mylib2.GetEarningsForSymbol(symbol, "ALL")
+	var eList []time.Time
+	err := WithRetry(ctx, "earnings for "+symbol, func() (err error) {
+		eList, err = mylib2.GetEarningsForSymbol(symbol, "ALL")
+		return err
+	})
 	if err != nil {
-		log.Fatal("Can't find earnings")
+		return lastEarnings, nextEarnings, surprise, IsEarnings, &PipelineError{Symbol: symbol, Date: histdate, Err: fmt.Errorf("%w: %v", ErrNoEarnings, err)}
 	}
 	for i, eDate := range eList {
 		if eDate.After(histdate) || eDate.Equal(histdate) {
@@ -464,7 +959,7 @@ func GetEarnings(symbol string, histdate time.Time) (time.Time, time.Time, float
 		}
 
 	}
-	return lastEarnings, nextEarnings, surprise, IsEarnings
+	return lastEarnings, nextEarnings, surprise, IsEarnings, nil
 }
 
 func CompareDateLists2(DateList []mylib2.DateRec, trendDates []time.Time) ([]mylib2.DateRec, bool) {
@@ -519,13 +1014,18 @@ func CompareDateLists(DateList []mylib2.DateRec, trendDates []time.Time) ([]myli
 	return result, nil
 }
 
-func AddExpectedMoves(symbol string) {
+func AddExpectedMoves(ctx context.Context, symbol string, rng DateRange) (int64, error) {
+	var written, issues int64
+
 	fmt.Printf("Calculating Expected Moves for %v\n", symbol)
 	filter := bson.D{{Key: "underlying", Value: symbol}}
-	stockHist, hstatus := mylib2.GetStockHistoryData(filter)
-	if !hstatus {
+	stockHist, err := FindStockHistory(ctx, filter)
+	if err != nil {
+		return 0, &PipelineError{Symbol: symbol, Err: err}
+	}
+	if len(stockHist) == 0 {
 		fmt.Printf("no stock history for %v. skipping symbol\n", symbol)
-		return
+		return 0, nil
 	}
 	hmap := make(map[time.Time]mylib2.StockHistory)
 
@@ -533,6 +1033,9 @@ func AddExpectedMoves(symbol string) {
 		hmap[day.Datadate] = day
 	}
 	for _, day := range stockHist {
+		if !rng.Contains(day.Datadate) {
+			continue
+		}
 		if day.NextEarningsDate.After(day.Datadate) {
 			ok, diff := mylib2.CalcDiffBeteenStockHistoryDates(day.Datadate, day.NextEarningsDate, stockHist)
 			if ok && (diff > 0 && diff <= 2) {
@@ -541,38 +1044,59 @@ func AddExpectedMoves(symbol string) {
 					good, expMove := mylib2.CalcExpectedMove(eDay)
 					if good {
 						filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "datadate", Value: day.Datadate}}
-						update := bson.D{{Key: "$set", Value: bson.D{{Key: "expectedmove", Value: expMove}}}}
-						matched, updated := mylib2.UpdateOne("StockHistory", filter, update)
+						update := bson.D{{Key: "$set", Value: bson.D{{Key: "expectedmove", Value: expMove}, AlgoVersion("em", EMVERSION)}}}
+						matched, updated, err := UpdateStockHistoryOne(ctx, "em", filter, update)
+						if err != nil {
+							return written, &PipelineError{Symbol: symbol, Date: day.Datadate, Err: err}
+						}
 						if matched != 1 && updated != 1 {
 							fmt.Printf("Issue Updating document %v %v\n", filter, update)
+							issues++
+						} else {
+							written++
 						}
 					}
 				}
 			}
 		}
 	}
+	return written, updateIssues(symbol, written, issues)
 }
 
-func AddExpectedMovePercentiles(symbol string) {
+func AddExpectedMovePercentiles(ctx context.Context, symbol string, rng DateRange) (int64, error) {
+	var written, issues int64
 
 	fmt.Printf("Calculating Expected Move Percentiles for %v\n", symbol)
-	filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "expectedmove", Value: bson.M{"$gt": 0}}}
-	stockHist, hstatus := mylib2.GetStockHistoryData(filter)
-	if !hstatus {
+	// moves of the tickers this symbol replaced count towards the ranking
+	stockHist, err := GetLinkedStockHistory(ctx, symbol, bson.E{Key: "expectedmove", Value: bson.M{"$gt": 0}})
+	if err != nil {
+		return 0, &PipelineError{Symbol: symbol, Err: err}
+	}
+	if len(stockHist) == 0 {
 		fmt.Printf("no stock history for %v. skipping symbol\n", symbol)
-		return
+		return 0, nil
 	}
 	moves := mylib2.GetFloats("expectedmove", stockHist)
 
 	for _, day := range stockHist {
+		if day.Underlying != symbol || !rng.Contains(day.Datadate) {
+			continue
+		}
 		percentile := MyPercentile(moves, day.ExpectedMove)
 		filter := bson.D{{Key: "underlying", Value: symbol}, {Key: "datadate", Value: day.Datadate}}
-		update := bson.D{{Key: "$set", Value: bson.D{{Key: "expectedmovepercentile", Value: percentile}}}}
-		matched, updated := mylib2.UpdateOne("StockHistory", filter, update)
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "expectedmovepercentile", Value: percentile}, AlgoVersion("empct", EMPCTVERSION)}}}
+		matched, updated, err := UpdateStockHistoryOne(ctx, "empct", filter, update)
+		if err != nil {
+			return written, &PipelineError{Symbol: symbol, Date: day.Datadate, Err: err}
+		}
 		if matched != 1 && updated != 1 {
 			fmt.Printf("Issue Updating document %v %v\n", filter, update)
+			issues++
+		} else {
+			written++
 		}
 	}
+	return written, updateIssues(symbol, written, issues)
 }
 
 /*
@@ -584,21 +1108,30 @@ func AddExpectedMovePercentiles(symbol string) {
 	4. update record
 */
 
-func AddIVpercentiles(symbol string) {
-
+func AddIVpercentiles(ctx context.Context, symbol string, actions CorporateActionSource, rng DateRange) (int64, error) {
+	var written, issues int64
 	var slice []mylib2.StockHistory
+
 	fmt.Printf("Calculating IV Percentiles for %v\n", symbol)
-	filter := bson.D{{Key: "underlying", Value: symbol}}
-	stockHist, hstatus := mylib2.GetStockHistoryData(filter)
-	if !hstatus {
+	// windows reach back into the history of the tickers this symbol replaced
+	stockHist, err := GetLinkedStockHistory(ctx, symbol)
+	if err != nil {
+		return 0, &PipelineError{Symbol: symbol, Err: err}
+	}
+	if len(stockHist) == 0 {
 		fmt.Printf("no stock history for %v. skipping symbol\n", symbol)
-		return
+		return 0, nil
+	}
+	// upricechange and histvol must not see splits as moves
+	stockHist, _, err = SplitAdjustedHistory(symbol, stockHist, actions)
+	if err != nil {
+		return 0, &PipelineError{Symbol: symbol, Err: err}
 	}
 
 	if len(stockHist) >= TDAYSANNUALY {
 		//slice = stockHist[len(stockHist)-TDAYSANNUALY:]
 		for i, h := range stockHist {
-			if i >= TDAYSANNUALY {
+			if i >= TDAYSANNUALY && h.Underlying == symbol && rng.Contains(h.Datadate) {
 				if i == TDAYSANNUALY {
 					slice = stockHist[:i+1]
 				} else {
@@ -683,16 +1216,32 @@ func AddIVpercentiles(symbol string) {
 					{Key: "upricechange365", Value: ud365},
 					{Key: "histvol", Value: hvol},
 					{Key: "maxup", Value: maxUp},
-					{Key: "maxdown", Value: maxDown}}}}
-				matched, updated := mylib2.UpdateOne("StockHistory", filter, update)
+					{Key: "maxdown", Value: maxDown},
+					AlgoVersion("ivpct", IVPCTVERSION)}}}
+				matched, updated, err := UpdateStockHistoryOne(ctx, "ivpct", filter, update)
+				if err != nil {
+					return written, &PipelineError{Symbol: symbol, Date: h.Datadate, Err: err}
+				}
 				if matched != 1 {
 					fmt.Printf("Issue Updating document %v %v\n", h, updated)
+					issues++
+				} else {
+					written++
 				}
 
 			}
 		}
 
 	}
+	return written, updateIssues(symbol, written, issues)
+}
+
+// updateIssues turns the count of UpdateOne calls that matched nothing into an error
+func updateIssues(symbol string, written int64, issues int64) error {
+	if issues == 0 {
+		return nil
+	}
+	return &PipelineError{Symbol: symbol, Err: fmt.Errorf("%w: %v of %v", ErrUpdateFailed, issues, written+issues)}
 }
 
 func CalcUpriceChange2(hist []mylib2.StockHistory, currRecIdx int, offset int) float64 {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// a base step that only has work the first time, like VolTrend once the new dates are written
+func TestRetrySymbolKeepsSucceededSteps(t *testing.T) {
+	var baseCalls, depCalls int
+	steps := []Step{
+		{Name: "base", Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+			baseCalls++
+			if baseCalls > 1 {
+				return 0, ErrNothingToDo
+			}
+			return 5, nil
+		}},
+		{Name: "dep", DependsOn: []string{"base"}, Run: func(ctx context.Context, symbol string, opts RunOptions) (int64, error) {
+			depCalls++
+			if depCalls == 1 {
+				return 0, errors.New("write failed")
+			}
+			return 3, nil
+		}},
+	}
+	tests := []struct {
+		name      string
+		onError   string
+		retries   int
+		status    string
+		baseCalls int
+		depCalls  int
+		records   int64
+	}{
+		{name: "retry", onError: ONERRORRETRY, retries: 2, status: STATUSOK, baseCalls: 1, depCalls: 2, records: 8},
+		{name: "no retries left", onError: ONERRORRETRY, retries: 0, status: STATUSFAILED, baseCalls: 1, depCalls: 1, records: 5},
+		{name: "skip", onError: ONERRORSKIP, retries: 2, status: STATUSFAILED, baseCalls: 1, depCalls: 1, records: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseCalls, depCalls = 0, 0
+			opts := RunOptions{Steps: steps, OnError: tt.onError, Retries: tt.retries}
+			res := RetrySymbol(context.Background(), "TEST", opts)
+			if res.Status != tt.status {
+				t.Errorf("status %v, want %v (%v)", res.Status, tt.status, res.Error)
+			}
+			if baseCalls != tt.baseCalls || depCalls != tt.depCalls {
+				t.Errorf("base ran %v times, dep %v times, want %v and %v", baseCalls, depCalls, tt.baseCalls, tt.depCalls)
+			}
+			if res.Records != tt.records {
+				t.Errorf("records %v, want %v", res.Records, tt.records)
+			}
+		})
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     string
+		wantErr  bool
+	}{
+		{"", "", "open to open", false},
+		{"2024-01-02", "", "2024-01-02 to open", false},
+		{"", "2024-03-01", "open to 2024-03-01", false},
+		{"2024-01-02", "2024-03-01", "2024-01-02 to 2024-03-01", false},
+		{"2024-03-01", "2024-03-01", "2024-03-01 to 2024-03-01", false},
+		{"2024-03-01", "2024-01-02", "", true},
+		{"2024-13-01", "", "", true},
+		{"", "03/01/2024", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDateRange(tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q %q: error %v", tt.from, tt.to, err)
+			continue
+		}
+		if !tt.wantErr && got.String() != tt.want {
+			t.Errorf("%q %q: got %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestDateRangeContains(t *testing.T) {
+	rng := DateRange{From: date("2024-01-02"), To: date("2024-03-01")}
+	for d, want := range map[string]bool{"2024-01-01": false, "2024-01-02": true, "2024-02-01": true, "2024-03-01": true, "2024-03-02": false} {
+		if got := rng.Contains(date(d)); got != want {
+			t.Errorf("%v: got %v, want %v", d, got, want)
+		}
+	}
+	if !(DateRange{}).Contains(date("1999-01-01")) {
+		t.Errorf("an open range contains every date")
+	}
+}